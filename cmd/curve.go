@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Ccccraz/cogmoteGO/internal/keyring"
+	zmq "github.com/pebbe/zmq4"
+	"github.com/spf13/cobra"
+)
+
+var (
+	curveForce  bool
+	curveServer bool
+)
+
+// curveCmd represents the curve command
+var curveCmd = &cobra.Command{
+	Use:   "curve",
+	Short: "Show the CURVE public key of the command proxies",
+	Long:  "Show the CURVE public key command proxies authenticate with, task servers requiring encryption must accept it.",
+	Run: func(cmd *cobra.Command, args []string) {
+		public, _, err := keyring.GetCurveKeyPair()
+		if errors.Is(err, keyring.ErrNotFound) {
+			fmt.Fprintln(os.Stderr, "no CURVE keypair yet, create one with: cogmoteGO curve generate")
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read CURVE keypair: %v\n", err)
+			return
+		}
+
+		fmt.Println(public)
+	},
+}
+
+// curveGenerateCmd represents the curve generate command
+var curveGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate a CURVE keypair",
+	Long:  "Generate the CURVE keypair of the command proxies and store it in the system keyring, or with --server print a keypair for a task server without storing it.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !zmq.HasCurve() {
+			fmt.Fprintln(os.Stderr, "libzmq is built without CURVE support")
+			return
+		}
+
+		public, secret, err := zmq.NewCurveKeypair()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to generate CURVE keypair: %v\n", err)
+			return
+		}
+
+		if curveServer {
+			fmt.Printf("public key: %s\n", public)
+			fmt.Printf("secret key: %s\n", secret)
+			fmt.Println("pass the public key as server_key when creating the command proxy")
+			return
+		}
+
+		if _, _, err := keyring.GetCurveKeyPair(); err == nil && !curveForce {
+			fmt.Fprintln(os.Stderr, "a CURVE keypair already exists, replace it with --force")
+			return
+		} else if err != nil && !errors.Is(err, keyring.ErrNotFound) {
+			fmt.Fprintf(os.Stderr, "failed to read CURVE keypair: %v\n", err)
+			return
+		}
+
+		if err := keyring.SaveCurveKeyPair(public, secret); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to store CURVE keypair: %v\n", err)
+			return
+		}
+
+		fmt.Println("CURVE keypair saved to system keyring")
+		fmt.Printf("public key: %s\n", public)
+		fmt.Println("restart the service for running command proxies to use it")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(curveCmd)
+	curveCmd.AddCommand(curveGenerateCmd)
+	curveGenerateCmd.Flags().BoolVarP(&curveForce, "force", "f", false, "replace the existing keypair")
+	curveGenerateCmd.Flags().BoolVarP(&curveServer, "server", "s", false, "print a keypair for a task server instead of storing one")
+}
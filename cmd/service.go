@@ -15,6 +15,7 @@ import (
 	"github.com/Ccccraz/cogmoteGO/internal/health"
 	"github.com/Ccccraz/cogmoteGO/internal/logger"
 	"github.com/Ccccraz/cogmoteGO/internal/obs"
+	"github.com/Ccccraz/cogmoteGO/internal/rpc"
 	"github.com/Ccccraz/cogmoteGO/internal/status"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -40,7 +41,7 @@ func (p *program) run() {
 }
 
 func (p *program) Stop(s service.Service) error {
-	return nil
+	return rpc.Stop()
 }
 
 // serviceCmd represents the service command
@@ -135,6 +136,9 @@ func Serve() {
 
 	logger.Init(dev)
 	experiments.Init()
+	broadcast.Init(Config)
+	cmdproxy.Init(Config)
+	rpc.Init(Config)
 
 	r := gin.New()
 	if dev {
@@ -0,0 +1,611 @@
+package broadcast
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/commonTypes"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+// supported aggregation operations
+const (
+	AggregateCount = "count"
+	AggregateSum   = "sum"
+	AggregateMean  = "mean"
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+)
+
+// Aggregation is a named statistic over the JSON or MessagePack messages of
+// an endpoint, updated on every publish. Without a window it covers every
+// message since the endpoint was restored, seeded from the retained history.
+type Aggregation struct {
+	Name string `json:"name" binding:"required"`
+	// One of count, sum, mean, min or max
+	Op string `json:"op" binding:"required"`
+	// Dotted path of the numeric field, not used by count. Booleans count as
+	// 0 and 1, so the mean of a boolean field is a rate.
+	Field string `json:"field,omitempty"`
+	// Dotted path of the field to group the statistic by, e.g. result
+	GroupBy string `json:"group_by,omitempty"`
+	// Only aggregate messages matching this filter expression
+	Filter string `json:"filter,omitempty"`
+	// Only aggregate the last N messages
+	Window int `json:"window,omitempty"`
+	// Only aggregate messages of the last T seconds
+	WindowSeconds int64 `json:"window_seconds,omitempty"`
+}
+
+func (a Aggregation) validate() error {
+	if strings.Contains(a.Name, "/") {
+		return errors.New("name must not contain /")
+	}
+
+	switch a.Op {
+	case AggregateCount:
+	case AggregateSum, AggregateMean, AggregateMin, AggregateMax:
+		if a.Field == "" {
+			return fmt.Errorf("field is required for op: %s", a.Op)
+		}
+	default:
+		return fmt.Errorf("unsupported op: %s", a.Op)
+	}
+
+	if a.Window < 0 {
+		return errors.New("window must not be negative")
+	}
+	if a.WindowSeconds < 0 {
+		return errors.New("window_seconds must not be negative")
+	}
+	return nil
+}
+
+// AggregateValue is the statistic of a single group
+type AggregateValue struct {
+	// Number of aggregated messages
+	Count int `json:"count"`
+	// Value of the statistic, null if no message had a numeric field
+	Value *float64 `json:"value"`
+}
+
+// AggregateResult is a snapshot of an aggregation
+type AggregateResult struct {
+	Name string `json:"name"`
+	// Sequence number of the last aggregated message
+	Seq     uint64    `json:"seq"`
+	Updated time.Time `json:"updated"`
+	AggregateValue
+	Groups map[string]AggregateValue `json:"groups,omitempty"`
+}
+
+// running statistic of an aggregation
+type aggregateStats struct {
+	count int     // aggregated messages
+	n     int     // messages with a numeric field
+	sum   float64 // sum of numeric fields
+	min   float64
+	max   float64
+}
+
+func (s *aggregateStats) add(sample aggregateSample) {
+	s.count++
+	if !sample.hasValue {
+		return
+	}
+	if s.n == 0 || sample.value < s.min {
+		s.min = sample.value
+	}
+	if s.n == 0 || sample.value > s.max {
+		s.max = sample.value
+	}
+	s.n++
+	s.sum += sample.value
+}
+
+func (s *aggregateStats) result(op string) AggregateValue {
+	result := AggregateValue{Count: s.count}
+
+	var value float64
+	switch op {
+	case AggregateCount:
+		value = float64(s.count)
+	case AggregateSum:
+		value = s.sum
+	case AggregateMean:
+		if s.n == 0 {
+			return result
+		}
+		value = s.sum / float64(s.n)
+	case AggregateMin:
+		if s.n == 0 {
+			return result
+		}
+		value = s.min
+	case AggregateMax:
+		if s.n == 0 {
+			return result
+		}
+		value = s.max
+	}
+	result.Value = &value
+	return result
+}
+
+// the part of a message an aggregation keeps
+type aggregateSample struct {
+	time     time.Time
+	group    string
+	hasGroup bool
+	value    float64
+	hasValue bool
+}
+
+// live state of an aggregation, protected by the mutex of its endpoint
+type aggregator struct {
+	config  Aggregation
+	filter  filterNode
+	field   []string
+	groupBy []string
+
+	// samples in the window, only kept for windowed aggregations
+	samples []aggregateSample
+	// running statistics, only kept without a window
+	total  aggregateStats
+	groups map[string]*aggregateStats
+
+	seq     uint64
+	updated time.Time
+
+	// SSE streams of the aggregation, each only holds the latest snapshot
+	watchers map[chan AggregateResult]struct{}
+}
+
+func newAggregator(config Aggregation) (*aggregator, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	a := &aggregator{
+		config:   config,
+		groups:   make(map[string]*aggregateStats),
+		watchers: make(map[chan AggregateResult]struct{}),
+	}
+
+	if config.Filter != "" {
+		filter, err := parseFilter(config.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter: %w", err)
+		}
+		a.filter = filter
+	}
+	if config.Field != "" {
+		a.field = strings.Split(config.Field, ".")
+	}
+	if config.GroupBy != "" {
+		a.groupBy = strings.Split(config.GroupBy, ".")
+	}
+
+	return a, nil
+}
+
+func (a *aggregator) windowed() bool {
+	return a.config.Window > 0 || a.config.WindowSeconds > 0
+}
+
+// add a decoded message to the aggregation, reporting whether it was used
+func (a *aggregator) add(doc any, msg message) bool {
+	if a.filter != nil && !truthy(a.filter.eval(doc)) {
+		return false
+	}
+
+	sample := aggregateSample{time: msg.Time}
+	if a.field != nil {
+		if value, ok := lookup(doc, a.field); ok {
+			switch v := value.(type) {
+			case float64:
+				sample.value, sample.hasValue = v, true
+			case bool:
+				sample.hasValue = true
+				if v {
+					sample.value = 1
+				}
+			}
+		}
+	}
+	if a.groupBy != nil {
+		if value, ok := lookup(doc, a.groupBy); ok && value != nil {
+			sample.group, sample.hasGroup = groupKey(value), true
+		}
+	}
+
+	a.seq = msg.Seq
+	a.updated = msg.Time
+
+	if a.windowed() {
+		a.samples = append(a.samples, sample)
+		a.trim(msg.Time)
+		return true
+	}
+
+	a.total.add(sample)
+	if sample.hasGroup {
+		stats, ok := a.groups[sample.group]
+		if !ok {
+			stats = &aggregateStats{}
+			a.groups[sample.group] = stats
+		}
+		stats.add(sample)
+	}
+	return true
+}
+
+func groupKey(value any) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// drop samples that left the window
+func (a *aggregator) trim(now time.Time) {
+	n := 0
+	if a.config.Window > 0 && len(a.samples) > a.config.Window {
+		n = len(a.samples) - a.config.Window
+	}
+	if a.config.WindowSeconds > 0 {
+		cutoff := now.Add(-time.Duration(a.config.WindowSeconds) * time.Second)
+		for n < len(a.samples) && a.samples[n].time.Before(cutoff) {
+			n++
+		}
+	}
+	if n > 0 {
+		clear(a.samples[:n])
+		a.samples = a.samples[n:]
+	}
+}
+
+func (a *aggregator) snapshot(now time.Time) AggregateResult {
+	result := AggregateResult{
+		Name:    a.config.Name,
+		Seq:     a.seq,
+		Updated: a.updated,
+	}
+
+	total, groups := &a.total, a.groups
+	if a.windowed() {
+		a.trim(now)
+
+		total = &aggregateStats{}
+		groups = make(map[string]*aggregateStats)
+		for _, sample := range a.samples {
+			total.add(sample)
+			if sample.hasGroup {
+				stats, ok := groups[sample.group]
+				if !ok {
+					stats = &aggregateStats{}
+					groups[sample.group] = stats
+				}
+				stats.add(sample)
+			}
+		}
+	}
+
+	result.AggregateValue = total.result(a.config.Op)
+	if a.groupBy != nil {
+		result.Groups = make(map[string]AggregateValue, len(groups))
+		for group, stats := range groups {
+			result.Groups[group] = stats.result(a.config.Op)
+		}
+	}
+
+	return result
+}
+
+// hand the latest snapshot to every stream, replacing one not yet sent
+func (a *aggregator) notify(now time.Time) {
+	if len(a.watchers) == 0 {
+		return
+	}
+
+	result := a.snapshot(now)
+	for ch := range a.watchers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- result
+	}
+}
+
+// end every stream of the aggregation
+func (a *aggregator) close() {
+	for ch := range a.watchers {
+		close(ch)
+	}
+	clear(a.watchers)
+}
+
+// update every aggregation of the endpoint with msg
+func (e *BroadcastEndpoint) aggregateLocked(msg message) {
+	if len(e.aggregators) == 0 {
+		return
+	}
+
+	doc, ok := msg.decode()
+	if !ok {
+		// only JSON and MessagePack payloads can be aggregated
+		return
+	}
+
+	for _, a := range e.aggregators {
+		if a.add(doc, msg) {
+			a.notify(msg.Time)
+		}
+	}
+}
+
+// seed an aggregation from the retained history
+func (e *BroadcastEndpoint) seedLocked(a *aggregator) {
+	for _, msg := range e.history {
+		if doc, ok := msg.decode(); ok {
+			a.add(doc, msg)
+		}
+	}
+}
+
+func (e *BroadcastEndpoint) aggregationsLocked() []Aggregation {
+	if len(e.aggregators) == 0 {
+		return nil
+	}
+
+	configs := make([]Aggregation, 0, len(e.aggregators))
+	for _, a := range e.aggregators {
+		configs = append(configs, a.config)
+	}
+	return configs
+}
+
+func (e *BroadcastEndpoint) findAggregatorLocked(name string) (int, *aggregator) {
+	for i, a := range e.aggregators {
+		if a.config.Name == name {
+			return i, a
+		}
+	}
+	return -1, nil
+}
+
+// List the aggregations of the broadcast endpoint with their snapshots
+func GetAggregates(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	now := time.Now()
+	aggregates := make([]gin.H, 0, len(endpoint.aggregators))
+	for _, a := range endpoint.aggregators {
+		aggregates = append(aggregates, gin.H{
+			"aggregation": a.config,
+			"result":      a.snapshot(now),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"aggregates": aggregates,
+	})
+}
+
+// Add an aggregation to the broadcast endpoint
+func CreateAggregate(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	var config Aggregation
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid aggregation",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	a, err := newAggregator(config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid aggregation",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	if _, existing := endpoint.findAggregatorLocked(config.Name); existing != nil {
+		c.JSON(http.StatusConflict, commonTypes.APIError{
+			Error:  fmt.Sprintf("aggregation: %s already exists", config.Name),
+			Detail: "",
+		})
+		return
+	}
+
+	endpoint.trimLocked(time.Now())
+	endpoint.seedLocked(a)
+	endpoint.aggregators = append(endpoint.aggregators, a)
+
+	if err := endpoint.saveMetaLocked(); err != nil {
+		endpoint.aggregators = endpoint.aggregators[:len(endpoint.aggregators)-1]
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to save aggregation: %s", config.Name),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, a.snapshot(time.Now()))
+}
+
+// Get the current snapshot of an aggregation
+func GetAggregate(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+	aggregate := c.Param("aggregate")
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	_, a := endpoint.findAggregatorLocked(aggregate)
+	if a == nil {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("aggregation: %s does not exist", aggregate),
+			Detail: "",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, a.snapshot(time.Now()))
+}
+
+// Receive the snapshots of an aggregation via Server-Sent Events (SSE)
+// whenever it is updated. Slow clients only get the latest snapshot.
+func SubscribeAggregate(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+	aggregate := c.Param("aggregate")
+
+	ch := make(chan AggregateResult, 1)
+
+	endpoint.mu.Lock()
+	_, a := endpoint.findAggregatorLocked(aggregate)
+	if a == nil {
+		endpoint.mu.Unlock()
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("aggregation: %s does not exist", aggregate),
+			Detail: "",
+		})
+		return
+	}
+	a.watchers[ch] = struct{}{}
+	ch <- a.snapshot(time.Now())
+	endpoint.mu.Unlock()
+
+	defer func() {
+		endpoint.mu.Lock()
+		delete(a.watchers, ch)
+		endpoint.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case result, ok := <-ch:
+			if !ok {
+				// aggregation or endpoint was deleted
+				return
+			}
+			c.Render(-1, sse.Event{
+				Id:    strconv.FormatUint(result.Seq, 10),
+				Event: "aggregate",
+				Data:  result,
+			})
+			c.Writer.Flush()
+		case <-c.Writer.CloseNotify():
+			return
+		}
+	}
+}
+
+// Delete an aggregation of the broadcast endpoint
+func DeleteAggregate(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+	aggregate := c.Param("aggregate")
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	i, a := endpoint.findAggregatorLocked(aggregate)
+	if a == nil {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("aggregation: %s does not exist", aggregate),
+			Detail: "",
+		})
+		return
+	}
+
+	a.close()
+	endpoint.aggregators = append(endpoint.aggregators[:i], endpoint.aggregators[i+1:]...)
+
+	if err := endpoint.saveMetaLocked(); err != nil {
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to save aggregations after deleting: %s", aggregate),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
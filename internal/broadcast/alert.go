@@ -0,0 +1,582 @@
+package broadcast
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/commonTypes"
+	"github.com/Ccccraz/cogmoteGO/internal/email"
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// how often alert rules are checked between publishes, for silence timeouts
+// and time windows
+const alertCheckInterval = time.Second
+
+// states of an alert rule
+const (
+	AlertOK           = "ok"
+	AlertFiring       = "firing"
+	AlertAcknowledged = "acknowledged"
+)
+
+// AlertRule is a condition on the JSON or MessagePack messages of an
+// endpoint. An email is sent through the email settings when the condition
+// starts to hold, e.g.
+//
+//	{"name": "low_rate", "field": "correct", "op": "<", "threshold": 0.5, "window": 50}
+//	{"name": "stalled", "silence_seconds": 600}
+type AlertRule struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description,omitempty"`
+	// Dotted path of the numeric field compared to the threshold. Booleans
+	// count as 0 and 1, so with a window the compared mean is a rate.
+	Field string `json:"field,omitempty"`
+	// One of <, <=, >, >=, == or !=
+	Op        string   `json:"op,omitempty"`
+	Threshold *float64 `json:"threshold,omitempty"`
+	// Only consider messages matching this filter expression
+	Filter string `json:"filter,omitempty"`
+	// Compare the mean of the last N messages instead of the latest value
+	Window int `json:"window,omitempty"`
+	// Compare the mean of the messages of the last T seconds
+	WindowSeconds int64 `json:"window_seconds,omitempty"`
+	// Messages needed in the window before the threshold is checked
+	MinCount int `json:"min_count,omitempty"`
+	// Fire when no message arrived for this many seconds
+	SilenceSeconds int64 `json:"silence_seconds,omitempty"`
+}
+
+func (r AlertRule) validate() error {
+	if strings.Contains(r.Name, "/") {
+		return errors.New("name must not contain /")
+	}
+
+	threshold := r.Field != "" || r.Op != "" || r.Threshold != nil
+	if threshold {
+		if r.Field == "" || r.Threshold == nil {
+			return errors.New("field and threshold are required for a threshold rule")
+		}
+		switch r.Op {
+		case "<", "<=", ">", ">=", "==", "!=":
+		default:
+			return fmt.Errorf("unsupported op: %s", r.Op)
+		}
+	}
+
+	if r.SilenceSeconds < 0 {
+		return errors.New("silence_seconds must not be negative")
+	}
+	if !threshold && r.SilenceSeconds == 0 {
+		return errors.New("rule needs a threshold or silence_seconds")
+	}
+	if r.MinCount < 0 {
+		return errors.New("min_count must not be negative")
+	}
+	return nil
+}
+
+// AlertStatus is an alert rule with its current state
+type AlertStatus struct {
+	Endpoint string    `json:"endpoint"`
+	Rule     AlertRule `json:"rule"`
+	// One of ok, firing or acknowledged
+	State string `json:"state"`
+	// Latest value compared to the threshold, null if there is none
+	Value *float64 `json:"value"`
+	// Why the alert fired
+	Reason         string     `json:"reason,omitempty"`
+	FiredAt        *time.Time `json:"fired_at,omitempty"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+	// Whether the email for the latest firing was sent
+	Notified    bool   `json:"notified"`
+	NotifyError string `json:"notify_error,omitempty"`
+}
+
+// live state of an alert rule, protected by the mutex of its endpoint
+type alert struct {
+	rule AlertRule
+	// keeps the messages compared to the threshold and the time of the last
+	// matching message
+	agg *aggregator
+	// silence is measured from here until a message arrives
+	started time.Time
+	status  AlertStatus
+}
+
+func newAlert(rule AlertRule) (*alert, error) {
+	if err := rule.validate(); err != nil {
+		return nil, err
+	}
+
+	config := Aggregation{
+		Name:          rule.Name,
+		Op:            AggregateCount,
+		Filter:        rule.Filter,
+		Window:        rule.Window,
+		WindowSeconds: rule.WindowSeconds,
+	}
+	if rule.Field != "" {
+		config.Op, config.Field = AggregateMean, rule.Field
+	}
+	if config.Window == 0 && config.WindowSeconds == 0 {
+		// only the latest value
+		config.Window = 1
+	}
+
+	agg, err := newAggregator(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &alert{
+		rule:    rule,
+		agg:     agg,
+		started: time.Now(),
+		status: AlertStatus{
+			Rule:  rule,
+			State: AlertOK,
+		},
+	}, nil
+}
+
+// check whether the condition of the rule holds, and why
+func (a *alert) evaluate(now time.Time) (string, bool) {
+	if a.rule.Threshold != nil {
+		result := a.agg.snapshot(now)
+		a.status.Value = result.Value
+
+		if result.Value != nil && result.Count >= max(a.rule.MinCount, 1) {
+			value, threshold := *result.Value, *a.rule.Threshold
+			cmp, _ := compare(value, threshold)
+
+			var holds bool
+			switch a.rule.Op {
+			case "<":
+				holds = cmp < 0
+			case "<=":
+				holds = cmp <= 0
+			case ">":
+				holds = cmp > 0
+			case ">=":
+				holds = cmp >= 0
+			case "==":
+				holds = cmp == 0
+			case "!=":
+				holds = cmp != 0
+			}
+
+			if holds {
+				if a.rule.Window > 1 || a.rule.WindowSeconds > 0 {
+					return fmt.Sprintf("mean of %s over %d messages is %g, %s %g",
+						a.rule.Field, result.Count, value, a.rule.Op, threshold), true
+				}
+				return fmt.Sprintf("%s is %g, %s %g", a.rule.Field, value, a.rule.Op, threshold), true
+			}
+		}
+	}
+
+	if a.rule.SilenceSeconds > 0 {
+		last := a.started
+		if a.agg.updated.After(last) {
+			last = a.agg.updated
+		}
+		if silence := now.Sub(last); silence >= time.Duration(a.rule.SilenceSeconds)*time.Second {
+			return fmt.Sprintf("no message for %s", silence.Truncate(time.Second)), true
+		}
+	}
+
+	return "", false
+}
+
+// update the state of the alert, reporting whether it started firing
+func (a *alert) updateLocked(now time.Time) bool {
+	reason, holds := a.evaluate(now)
+
+	switch {
+	case holds && a.status.State == AlertOK:
+		a.status.State = AlertFiring
+		a.status.Reason = reason
+		a.status.FiredAt = &now
+		a.status.AcknowledgedAt = nil
+		a.status.ResolvedAt = nil
+		a.status.Notified = false
+		a.status.NotifyError = ""
+		return true
+	case !holds && a.status.State != AlertOK:
+		a.status.State = AlertOK
+		a.status.ResolvedAt = &now
+	}
+	return false
+}
+
+// check every alert rule of the endpoint, after msg was published or on a
+// tick when msg is nil
+func (e *BroadcastEndpoint) alertLocked(msg *message, now time.Time) {
+	if len(e.alerts) == 0 {
+		return
+	}
+
+	var doc any
+	decoded := false
+	if msg != nil {
+		doc, decoded = msg.decode()
+	}
+
+	for _, a := range e.alerts {
+		if decoded {
+			a.agg.add(doc, *msg)
+		}
+		if a.updateLocked(now) {
+			e.notifyAlertLocked(a)
+		}
+	}
+}
+
+// send the email of a firing alert in the background
+func (e *BroadcastEndpoint) notifyAlertLocked(a *alert) {
+	status := e.alertStatusLocked(a)
+
+	logger.Logger.Warn(
+		"broadcast alert fired: ",
+		slog.Group(
+			logKey,
+			slog.String("endpoint", e.name),
+			slog.String("alert", a.rule.Name),
+			slog.String("reason", status.Reason),
+		),
+	)
+
+	go func() {
+		subject := fmt.Sprintf("[cogmoteGO] alert %s on %s", status.Rule.Name, status.Endpoint)
+		body := fmt.Sprintf("<p>Alert <b>%s</b> on broadcast endpoint <b>%s</b> fired at %s.</p><p>%s</p>",
+			html.EscapeString(status.Rule.Name),
+			html.EscapeString(status.Endpoint),
+			status.FiredAt.Format(time.RFC1123),
+			html.EscapeString(status.Reason),
+		)
+		if status.Rule.Description != "" {
+			body += fmt.Sprintf("<p>%s</p>", html.EscapeString(status.Rule.Description))
+		}
+
+		err := email.Send(subject, body)
+		if err != nil {
+			logger.Logger.Error(
+				"failed to send broadcast alert: ",
+				slog.Group(
+					logKey,
+					slog.String("endpoint", status.Endpoint),
+					slog.String("alert", status.Rule.Name),
+					slog.String("error", err.Error()),
+				),
+			)
+		}
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		if a.status.FiredAt != status.FiredAt {
+			// fired again in the meantime
+			return
+		}
+		a.status.Notified = err == nil
+		if err != nil {
+			a.status.NotifyError = err.Error()
+		}
+	}()
+}
+
+func (e *BroadcastEndpoint) alertRulesLocked() []AlertRule {
+	if len(e.alerts) == 0 {
+		return nil
+	}
+
+	rules := make([]AlertRule, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		rules = append(rules, a.rule)
+	}
+	return rules
+}
+
+func (e *BroadcastEndpoint) findAlertLocked(name string) (int, *alert) {
+	for i, a := range e.alerts {
+		if a.rule.Name == name {
+			return i, a
+		}
+	}
+	return -1, nil
+}
+
+func (e *BroadcastEndpoint) alertStatusLocked(a *alert) AlertStatus {
+	status := a.status
+	status.Endpoint = e.name
+	return status
+}
+
+// periodically check the alert rules of every endpoint
+func watchAlerts() {
+	ticker := time.NewTicker(alertCheckInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		broadEndpointsMu.RLock()
+		for _, endpoint := range broadEndpoints {
+			endpoint.mu.Lock()
+			endpoint.alertLocked(nil, now)
+			endpoint.mu.Unlock()
+		}
+		broadEndpointsMu.RUnlock()
+	}
+}
+
+// List the alerts of every endpoint, only those in the given state with
+// ?state=firing
+func GetAlerts(c *gin.Context) {
+	state := c.Query("state")
+
+	broadEndpointsMu.RLock()
+	defer broadEndpointsMu.RUnlock()
+
+	alerts := make([]AlertStatus, 0)
+	for _, endpoint := range broadEndpoints {
+		endpoint.mu.Lock()
+		for _, a := range endpoint.alerts {
+			if state == "" || a.status.State == state {
+				alerts = append(alerts, endpoint.alertStatusLocked(a))
+			}
+		}
+		endpoint.mu.Unlock()
+	}
+
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Endpoint != alerts[j].Endpoint {
+			return alerts[i].Endpoint < alerts[j].Endpoint
+		}
+		return alerts[i].Rule.Name < alerts[j].Rule.Name
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"alerts": alerts,
+	})
+}
+
+// List the alert rules of the broadcast endpoint with their state
+func GetBroadcastAlerts(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	alerts := make([]AlertStatus, 0, len(endpoint.alerts))
+	for _, a := range endpoint.alerts {
+		alerts = append(alerts, endpoint.alertStatusLocked(a))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"alerts": alerts,
+	})
+}
+
+// Add an alert rule to the broadcast endpoint
+func CreateBroadcastAlert(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	var rule AlertRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid alert rule",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	a, err := newAlert(rule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid alert rule",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	if _, existing := endpoint.findAlertLocked(rule.Name); existing != nil {
+		c.JSON(http.StatusConflict, commonTypes.APIError{
+			Error:  fmt.Sprintf("alert: %s already exists", rule.Name),
+			Detail: "",
+		})
+		return
+	}
+
+	endpoint.trimLocked(time.Now())
+	endpoint.alerts = append(endpoint.alerts, a)
+
+	if err := endpoint.saveMetaLocked(); err != nil {
+		endpoint.alerts = endpoint.alerts[:len(endpoint.alerts)-1]
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to save alert: %s", rule.Name),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	endpoint.seedLocked(a.agg)
+	if a.updateLocked(time.Now()) {
+		endpoint.notifyAlertLocked(a)
+	}
+
+	c.JSON(http.StatusCreated, endpoint.alertStatusLocked(a))
+}
+
+// Get an alert rule of the broadcast endpoint with its state
+func GetBroadcastAlert(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+	alertName := c.Param("alert")
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	_, a := endpoint.findAlertLocked(alertName)
+	if a == nil {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("alert: %s does not exist", alertName),
+			Detail: "",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, endpoint.alertStatusLocked(a))
+}
+
+// Acknowledge a firing alert, it stays acknowledged until its condition
+// clears and is notified again the next time it fires
+func AcknowledgeBroadcastAlert(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+	alertName := c.Param("alert")
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	_, a := endpoint.findAlertLocked(alertName)
+	if a == nil {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("alert: %s does not exist", alertName),
+			Detail: "",
+		})
+		return
+	}
+
+	if a.status.State != AlertFiring {
+		c.JSON(http.StatusConflict, commonTypes.APIError{
+			Error:  fmt.Sprintf("alert: %s is not firing", alertName),
+			Detail: fmt.Sprintf("state: %s", a.status.State),
+		})
+		return
+	}
+
+	now := time.Now()
+	a.status.State = AlertAcknowledged
+	a.status.AcknowledgedAt = &now
+
+	c.JSON(http.StatusOK, endpoint.alertStatusLocked(a))
+}
+
+// Delete an alert rule of the broadcast endpoint
+func DeleteBroadcastAlert(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+	alertName := c.Param("alert")
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	i, a := endpoint.findAlertLocked(alertName)
+	if a == nil {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("alert: %s does not exist", alertName),
+			Detail: "",
+		})
+		return
+	}
+
+	endpoint.alerts = append(endpoint.alerts[:i], endpoint.alerts[i+1:]...)
+
+	if err := endpoint.saveMetaLocked(); err != nil {
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to save alerts after deleting: %s", alertName),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,275 @@
+package broadcast
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/commonTypes"
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// what happens to a message when a subscriber buffer is full
+const (
+	// discard the new message
+	PolicyDropNewest = "drop-newest"
+	// discard the oldest buffered message to make room for the new one
+	PolicyDropOldest = "drop-oldest"
+	// wait up to the block timeout for room, then discard the new message
+	PolicyBlock = "block"
+	// disconnect the subscriber
+	PolicyDisconnect = "disconnect"
+)
+
+// Backpressure configures how an endpoint treats slow subscribers. Zero
+// fields fall back to the defaults from the broadcast section of the config
+// file.
+type Backpressure struct {
+	// One of drop-newest, drop-oldest, block or disconnect
+	Policy string `json:"policy,omitempty"`
+	// Number of messages buffered per subscriber
+	BufferSize int `json:"buffer_size,omitempty"`
+	// Time in milliseconds the block policy waits for room in a buffer
+	BlockTimeout int `json:"block_timeout,omitempty"`
+}
+
+func (b Backpressure) withDefaults() Backpressure {
+	if b.Policy == "" {
+		b.Policy = cfg.Broadcast.Policy
+	}
+	if b.Policy == "" {
+		b.Policy = PolicyDropNewest
+	}
+	if b.BufferSize <= 0 {
+		b.BufferSize = cfg.Broadcast.BufferSize
+	}
+	if b.BufferSize <= 0 {
+		b.BufferSize = 64
+	}
+	if b.BlockTimeout <= 0 {
+		b.BlockTimeout = cfg.Broadcast.BlockTimeout
+	}
+	if b.BlockTimeout <= 0 {
+		b.BlockTimeout = 100
+	}
+	return b
+}
+
+func (b Backpressure) validate() error {
+	switch b.Policy {
+	case "", PolicyDropNewest, PolicyDropOldest, PolicyBlock, PolicyDisconnect:
+	default:
+		return fmt.Errorf("unsupported policy: %s", b.Policy)
+	}
+	if b.BufferSize < 0 {
+		return fmt.Errorf("buffer_size must not be negative")
+	}
+	if b.BlockTimeout < 0 {
+		return fmt.Errorf("block_timeout must not be negative")
+	}
+	return nil
+}
+
+// a single consumer of a broadcast endpoint
+type subscriber struct {
+	id          uint64
+	transport   string
+	remote      string
+	connectedAt time.Time
+
+	ch        chan message
+	done      chan struct{} // closed once the subscriber is removed
+	closeOnce sync.Once
+
+	enqueued atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+// whether the subscriber belongs to the endpoint itself, like the PUB socket
+// of the zmq bridge, rather than to a client
+func (s *subscriber) internal() bool {
+	return s.transport == "zmq"
+}
+
+func (s *subscriber) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// subscriber as reported by the API
+type SubscriberInfo struct {
+	ID          uint64    `json:"id"`
+	Transport   string    `json:"transport"`
+	Remote      string    `json:"remote"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Buffered    int       `json:"buffered"`
+	BufferSize  int       `json:"buffer_size"`
+	Enqueued    uint64    `json:"enqueued"`
+	Dropped     uint64    `json:"dropped"`
+}
+
+// hand msg to sub according to the backpressure policy
+func (e *BroadcastEndpoint) deliver(sub *subscriber, msg message, bp Backpressure) {
+	select {
+	case sub.ch <- msg:
+		sub.enqueued.Add(1)
+		return
+	case <-sub.done:
+		return
+	default:
+	}
+
+	switch bp.Policy {
+	case PolicyDropOldest:
+		for {
+			select {
+			case sub.ch <- msg:
+				sub.enqueued.Add(1)
+				return
+			case <-sub.ch:
+				e.countDropped(sub)
+			case <-sub.done:
+				return
+			}
+		}
+	case PolicyBlock:
+		timer := time.NewTimer(time.Duration(bp.BlockTimeout) * time.Millisecond)
+		defer timer.Stop()
+
+		select {
+		case sub.ch <- msg:
+			sub.enqueued.Add(1)
+		case <-timer.C:
+			e.countDropped(sub)
+		case <-sub.done:
+		}
+	case PolicyDisconnect:
+		e.countDropped(sub)
+		logger.Logger.Warn(
+			"disconnecting slow subscriber: ",
+			slog.Group(
+				logKey,
+				slog.String("endpoint", e.name),
+				slog.Uint64("subscriber", sub.id),
+				slog.String("remote", sub.remote),
+			),
+		)
+		e.unsubscribe(sub)
+	default:
+		e.countDropped(sub)
+	}
+}
+
+func (e *BroadcastEndpoint) countDropped(sub *subscriber) {
+	// only log the first drop of a subscriber to avoid flooding the log
+	if sub.dropped.Add(1) == 1 {
+		logger.Logger.Warn(
+			"subscriber buffer is full, dropping messages: ",
+			slog.Group(
+				logKey,
+				slog.String("endpoint", e.name),
+				slog.Uint64("subscriber", sub.id),
+				slog.String("remote", sub.remote),
+			),
+		)
+	}
+	e.dropped.Add(1)
+}
+
+func (e *BroadcastEndpoint) subscriberInfos() []SubscriberInfo {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	infos := make([]SubscriberInfo, 0, len(e.subscribers))
+	for _, sub := range e.subscribers {
+		infos = append(infos, SubscriberInfo{
+			ID:          sub.id,
+			Transport:   sub.transport,
+			Remote:      sub.remote,
+			ConnectedAt: sub.connectedAt,
+			Buffered:    len(sub.ch),
+			BufferSize:  cap(sub.ch),
+			Enqueued:    sub.enqueued.Load(),
+			Dropped:     sub.dropped.Load(),
+		})
+	}
+	return infos
+}
+
+// List the subscribers of the broadcast endpoint with their drop counters
+func GetBroadcastSubscribers(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	endpoint.mu.Lock()
+	backpressure := endpoint.backpressure.withDefaults()
+	endpoint.mu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"backpressure": backpressure,
+		"dropped":      endpoint.dropped.Load(),
+		"subscribers":  endpoint.subscriberInfos(),
+	})
+}
+
+// Change the backpressure policy of the broadcast endpoint, the buffer size
+// only applies to new subscribers
+func SetBroadcastBackpressure(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	var backpressure Backpressure
+	if err := c.ShouldBindJSON(&backpressure); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid backpressure config",
+			Detail: err.Error(),
+		})
+		return
+	}
+	if err := backpressure.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid backpressure config",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	endpoint.backpressure = backpressure
+	if err := endpoint.saveMetaLocked(); err != nil {
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to save backpressure config for endpoint: %s", name),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, backpressure.withDefaults())
+}
@@ -0,0 +1,229 @@
+package broadcast
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/Ccccraz/cogmoteGO/internal/commonTypes"
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// BatchResult reports the messages published from a batch or a stream
+type BatchResult struct {
+	Published int `json:"published"`
+	// Sequence numbers of the first and last published message, zero if
+	// nothing was published
+	FirstSeq uint64 `json:"first_seq"`
+	LastSeq  uint64 `json:"last_seq"`
+	// Lines of a stream that were rejected and skipped
+	Rejected  int    `json:"rejected,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func (r *BatchResult) add(msg message) {
+	if r.Published == 0 {
+		r.FirstSeq = msg.Seq
+	}
+	r.Published++
+	r.LastSeq = msg.Seq
+}
+
+// whether the Content-Type is newline delimited JSON
+func isNDJSON(contentType string) bool {
+	switch contentType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines":
+		return true
+	}
+	return false
+}
+
+// split a batch body into its JSON messages, either one per line of NDJSON
+// or one per element of a JSON array
+func splitBatch(data []byte, contentType string) ([][]byte, error) {
+	if isNDJSON(contentType) {
+		var items [][]byte
+		for i, line := range bytes.Split(data, []byte("\n")) {
+			line = bytes.TrimSpace(line)
+			if len(line) == 0 {
+				continue
+			}
+			if !json.Valid(line) {
+				return nil, fmt.Errorf("line %d is not valid JSON", i+1)
+			}
+			items = append(items, line)
+		}
+		return items, nil
+	}
+
+	if contentType != contentTypeJSON {
+		return nil, fmt.Errorf("unsupported batch content type: %s", contentType)
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '[' {
+		return nil, errors.New("batch must be a JSON array")
+	}
+
+	var elements []json.RawMessage
+	if err := json.Unmarshal(data, &elements); err != nil {
+		return nil, fmt.Errorf("invalid JSON array: %w", err)
+	}
+
+	items := make([][]byte, 0, len(elements))
+	for _, element := range elements {
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, element); err != nil {
+			return nil, err
+		}
+		items = append(items, compacted.Bytes())
+	}
+	return items, nil
+}
+
+// publish a batch of messages of the same content type. The whole batch is
+// rejected if any message does not match the schema, otherwise the messages
+// get consecutive sequence numbers and are delivered in order.
+func (e *BroadcastEndpoint) publishBatch(items [][]byte, contentType string) ([]message, error) {
+	for i, data := range items {
+		if err := e.validate(data, contentType); err != nil {
+			var schemaErr *schemaError
+			if len(items) > 1 && errors.As(err, &schemaErr) {
+				return nil, &schemaError{
+					reason: fmt.Sprintf("message %d of batch: %s", i, schemaErr.reason),
+					detail: schemaErr.detail,
+				}
+			}
+			return nil, err
+		}
+	}
+
+	e.fanoutMu.Lock()
+	defer e.fanoutMu.Unlock()
+
+	e.mu.Lock()
+	msgs := make([]message, 0, len(items))
+	for _, data := range items {
+		msg := e.appendLocked(data, contentType)
+		e.recordLocked(msg)
+		e.aggregateLocked(msg)
+		e.alertLocked(&msg, msg.Time)
+		msgs = append(msgs, msg)
+	}
+	subscribers := slices.Clone(e.subscribers)
+	backpressure := e.backpressure.withDefaults()
+	e.mu.Unlock()
+
+	// deliver outside of mu so slow subscribers do not stall readers
+	for _, msg := range msgs {
+		for _, sub := range subscribers {
+			e.deliver(sub, msg, backpressure)
+		}
+	}
+
+	return msgs, nil
+}
+
+// publish the body of a batch request, see BroadcastData
+func broadcastBatch(c *gin.Context, endpoint *BroadcastEndpoint, data []byte, contentType string) {
+	items, err := splitBatch(data, contentType)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid batch",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	msgs, err := endpoint.publishBatch(items, contentTypeJSON)
+	if err != nil {
+		var schemaErr *schemaError
+		if errors.As(err, &schemaErr) {
+			c.JSON(http.StatusUnprocessableEntity, commonTypes.APIError{
+				Error:  schemaErr.reason,
+				Detail: schemaErr.detail,
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to publish data to endpoint: %s", endpoint.name),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	var result BatchResult
+	for _, msg := range msgs {
+		result.add(msg)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// Publish every line of a long-lived NDJSON upload as soon as it arrives,
+// e.g. a chunked POST kept open for the whole session. Lines that are not
+// valid JSON or do not match the schema are skipped and counted in the
+// result, which is sent once the upload ends.
+func StreamBroadcastData(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	var result BatchResult
+	reject := func(line int, err error) {
+		result.Rejected++
+		result.LastError = fmt.Sprintf("line %d: %s", line, err)
+	}
+
+	reader := bufio.NewReader(c.Request.Body)
+	for line := 1; ; line++ {
+		data, readErr := reader.ReadBytes('\n')
+
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			if !json.Valid(data) {
+				reject(line, errors.New("invalid JSON"))
+			} else if msg, err := endpoint.publish(data, contentTypeJSON); err != nil {
+				reject(line, err)
+			} else {
+				result.add(msg)
+			}
+		}
+
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			logger.Logger.Warn(
+				"broadcast upload interrupted: ",
+				slog.Group(
+					logKey,
+					slog.String("endpoint", name),
+					slog.Int("published", result.Published),
+					slog.String("error", readErr.Error()),
+				),
+			)
+			c.JSON(http.StatusBadRequest, commonTypes.APIError{
+				Error:  "upload interrupted",
+				Detail: readErr.Error(),
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, result)
+}
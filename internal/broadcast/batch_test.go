@@ -0,0 +1,162 @@
+package broadcast
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitBatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		contentType string
+		want        []string
+		wantErr     bool
+	}{
+		{
+			name:        "array",
+			data:        `[{"a": 1}, {"b": [1, 2]}, 3]`,
+			contentType: contentTypeJSON,
+			want:        []string{`{"a":1}`, `{"b":[1,2]}`, `3`},
+		},
+		{
+			name:        "empty array",
+			data:        ` [] `,
+			contentType: contentTypeJSON,
+			want:        []string{},
+		},
+		{
+			name:        "ndjson",
+			data:        "{\"a\": 1}\n\n  {\"b\": 2}  \n",
+			contentType: "application/x-ndjson",
+			want:        []string{`{"a": 1}`, `{"b": 2}`},
+		},
+		{
+			name:        "jsonl",
+			data:        "1\n2",
+			contentType: "application/jsonl",
+			want:        []string{`1`, `2`},
+		},
+		{name: "not an array", data: `{"a": 1}`, contentType: contentTypeJSON, wantErr: true},
+		{name: "invalid array", data: `[{"a": 1},`, contentType: contentTypeJSON, wantErr: true},
+		{name: "invalid ndjson line", data: "{\"a\": 1}\n{\"b\":", contentType: "application/x-ndjson", wantErr: true},
+		{name: "unsupported content type", data: `[1]`, contentType: "text/plain", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := splitBatch([]byte(tt.data), tt.contentType)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("splitBatch = %q, want error", items)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("splitBatch: %v", err)
+			}
+			got := []string{}
+			for _, item := range items {
+				got = append(got, string(item))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("splitBatch = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishBatch(t *testing.T) {
+	schema := json.RawMessage(`{"type": "object", "required": ["trial"]}`)
+
+	tests := []struct {
+		name       string
+		items      []string
+		wantSeqs   []uint64
+		wantReason string // empty when the batch is published
+	}{
+		{
+			name:     "valid batch",
+			items:    []string{`{"trial": 1}`, `{"trial": 2}`, `{"trial": 3}`},
+			wantSeqs: []uint64{2, 3, 4},
+		},
+		{
+			name:       "one invalid message rejects the batch",
+			items:      []string{`{"trial": 1}`, `{"result": "correct"}`, `{"trial": 3}`},
+			wantReason: "message 1 of batch",
+		},
+		{
+			name:       "invalid JSON rejects the batch",
+			items:      []string{`{"trial": 1}`, `{"trial":`},
+			wantReason: "message 1 of batch: data is not valid JSON",
+		},
+		{
+			name:       "single message",
+			items:      []string{`{"result": "correct"}`},
+			wantReason: "data does not match schema",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator, err := compileSchema(schema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := &BroadcastEndpoint{
+				name:      "test",
+				schema:    SchemaConfig{Schema: schema},
+				validator: validator,
+			}
+			sub := &subscriber{ch: make(chan message, 10), done: make(chan struct{}), transport: "sse"}
+			e.subscribers = append(e.subscribers, sub)
+
+			// history before the batch, so sequence numbers continue it
+			if _, err := e.publish([]byte(`{"trial": 0}`), contentTypeJSON); err != nil {
+				t.Fatal(err)
+			}
+			<-sub.ch
+
+			var items [][]byte
+			for _, item := range tt.items {
+				items = append(items, []byte(item))
+			}
+			msgs, err := e.publishBatch(items, contentTypeJSON)
+
+			if tt.wantReason != "" {
+				var schemaErr *schemaError
+				if !errors.As(err, &schemaErr) || !errors.Is(err, ErrSchemaViolation) {
+					t.Fatalf("publishBatch error = %v, want a schema violation", err)
+				}
+				if !strings.HasPrefix(schemaErr.reason, tt.wantReason) {
+					t.Errorf("publishBatch reason = %q, want prefix %q", schemaErr.reason, tt.wantReason)
+				}
+				if len(msgs) != 0 || len(e.history) != 1 || e.lastSeq != 1 || len(sub.ch) != 0 {
+					t.Errorf("rejected batch published %d messages, history %d, last seq %d, delivered %d",
+						len(msgs), len(e.history), e.lastSeq, len(sub.ch))
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("publishBatch: %v", err)
+			}
+			if got := seqsOf(msgs); !slices.Equal(got, tt.wantSeqs) {
+				t.Errorf("published %v, want %v", got, tt.wantSeqs)
+			}
+			if got := seqsOf(e.history[1:]); !slices.Equal(got, tt.wantSeqs) {
+				t.Errorf("history %v, want %v", got, tt.wantSeqs)
+			}
+			var delivered []message
+			for range tt.wantSeqs {
+				delivered = append(delivered, <-sub.ch)
+			}
+			if got := seqsOf(delivered); !slices.Equal(got, tt.wantSeqs) {
+				t.Errorf("delivered %v, want %v", got, tt.wantSeqs)
+			}
+		})
+	}
+}
@@ -0,0 +1,398 @@
+package broadcast
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/commonTypes"
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	"github.com/gin-gonic/gin"
+	zmq "github.com/pebbe/zmq4"
+)
+
+const (
+	ingestPull = "pull"
+	ingestSub  = "sub"
+
+	// how often the ingest loop checks whether the bridge was stopped
+	bridgePollInterval = 500 * time.Millisecond
+)
+
+// ZMQBridge configures the optional ZeroMQ sockets of a broadcast endpoint.
+// Messages received on the ingest socket are published like BroadcastData,
+// and every message of the endpoint is sent on the PUB socket as a three
+// frame message: endpoint name as topic, content type, then the payload.
+// Ingested payloads are published as ContentType, or with ContentTypeFrame
+// as the content type in the frame before the payload, so the messages of a
+// PUB socket can be ingested as they are.
+type ZMQBridge struct {
+	// Address the ingest socket binds to, e.g. tcp://*:5556
+	Ingest string `json:"ingest,omitempty"`
+	// Ingest socket type, "pull" (default) or "sub"
+	IngestType string `json:"ingest_type,omitempty"`
+	// Content type of ingested payloads, defaults to application/json
+	ContentType string `json:"content_type,omitempty"`
+	// Whether the frame before the payload carries its content type, an
+	// empty frame stands for ContentType
+	ContentTypeFrame bool `json:"content_type_frame,omitempty"`
+	// Address the PUB socket binds to, e.g. tcp://*:5557
+	Egress string `json:"egress,omitempty"`
+}
+
+func (b *ZMQBridge) validate() error {
+	if b.Ingest == "" && b.Egress == "" {
+		return errors.New("at least one of ingest or egress is required")
+	}
+
+	switch b.IngestType {
+	case "":
+		b.IngestType = ingestPull
+	case ingestPull, ingestSub:
+	default:
+		return fmt.Errorf("unsupported ingest_type: %s", b.IngestType)
+	}
+
+	b.ContentType = parseContentType(b.ContentType)
+	return nil
+}
+
+// running ZeroMQ sockets of an endpoint
+type zmqBridge struct {
+	context *zmq.Context
+	ingest  *zmq.Socket
+	egress  *zmq.Socket
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func startBridge(endpoint *BroadcastEndpoint, config ZMQBridge) (*zmqBridge, error) {
+	zctx, err := zmq.NewContext()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create context: %w", err)
+	}
+
+	b := &zmqBridge{
+		context: zctx,
+		stop:    make(chan struct{}),
+	}
+
+	if config.Ingest != "" {
+		socketType := zmq.PULL
+		if config.IngestType == ingestSub {
+			socketType = zmq.SUB
+		}
+
+		b.ingest, err = b.bind(socketType, config.Ingest)
+		if err != nil {
+			b.closeSockets()
+			return nil, fmt.Errorf("failed to bind ingest socket: %w", err)
+		}
+
+		if socketType == zmq.SUB {
+			if err := b.ingest.SetSubscribe(""); err != nil {
+				b.closeSockets()
+				return nil, fmt.Errorf("failed to subscribe ingest socket: %w", err)
+			}
+		}
+		if err := b.ingest.SetRcvtimeo(bridgePollInterval); err != nil {
+			b.closeSockets()
+			return nil, fmt.Errorf("failed to set ingest recv timeout: %w", err)
+		}
+	}
+
+	if config.Egress != "" {
+		b.egress, err = b.bind(zmq.PUB, config.Egress)
+		if err != nil {
+			b.closeSockets()
+			return nil, fmt.Errorf("failed to bind egress socket: %w", err)
+		}
+	}
+
+	if b.ingest != nil {
+		b.wg.Add(1)
+		go b.ingestLoop(endpoint, config)
+	}
+	if b.egress != nil {
+		_, sub := endpoint.subscribe(replayOptions{tail: -1}, "zmq", config.Egress)
+		b.wg.Add(1)
+		go b.egressLoop(endpoint, sub)
+	}
+
+	logger.Logger.Info(
+		"zmq bridge started: ",
+		slog.Group(
+			logKey,
+			slog.String("endpoint", endpoint.name),
+			slog.String("ingest", config.Ingest),
+			slog.String("ingestType", config.IngestType),
+			slog.String("egress", config.Egress),
+		),
+	)
+
+	return b, nil
+}
+
+func (b *zmqBridge) bind(socketType zmq.Type, address string) (*zmq.Socket, error) {
+	s, err := b.context.NewSocket(socketType)
+	if err != nil {
+		return nil, err
+	}
+	// do not hold pending messages when the bridge is closed
+	if err := s.SetLinger(0); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	if err := s.Bind(address); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// publish every message received on the ingest socket
+func (b *zmqBridge) ingestLoop(endpoint *BroadcastEndpoint, config ZMQBridge) {
+	defer b.wg.Done()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		default:
+		}
+
+		frames, err := b.ingest.RecvMessageBytes(0)
+		if err != nil {
+			switch zmq.AsErrno(err) {
+			case zmq.Errno(syscall.EAGAIN), zmq.Errno(syscall.EINTR):
+				continue
+			}
+			logger.Logger.Error(
+				"zmq bridge ingest failed: ",
+				slog.Group(
+					logKey,
+					slog.String("endpoint", endpoint.name),
+					slog.String("error", err.Error()),
+				),
+			)
+			return
+		}
+
+		// with multipart messages, e.g. topic and payload, the payload is last
+		if len(frames) == 0 {
+			continue
+		}
+		contentType := config.ContentType
+		if config.ContentTypeFrame && len(frames) > 1 {
+			if frame := frames[len(frames)-2]; len(frame) > 0 {
+				contentType = parseContentType(string(frame))
+			}
+		}
+		if _, err := endpoint.publish(frames[len(frames)-1], contentType); err != nil {
+			logger.Logger.Warn(
+				"zmq bridge dropped rejected message: ",
+				slog.Group(
+					logKey,
+					slog.String("endpoint", endpoint.name),
+					slog.String("error", err.Error()),
+				),
+			)
+		}
+	}
+}
+
+// forward every message of the endpoint to the PUB socket
+func (b *zmqBridge) egressLoop(endpoint *BroadcastEndpoint, sub *subscriber) {
+	defer b.wg.Done()
+	defer func() { endpoint.unsubscribe(sub) }()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-sub.done:
+			// disconnected by the backpressure policy, keep forwarding live data
+			_, sub = endpoint.subscribe(replayOptions{tail: -1}, sub.transport, sub.remote)
+		case msg := <-sub.ch:
+			if _, err := b.egress.SendMessage(endpoint.name, msg.contentType(), msg.Data); err != nil {
+				logger.Logger.Warn(
+					"zmq bridge egress failed: ",
+					slog.Group(
+						logKey,
+						slog.String("endpoint", endpoint.name),
+						slog.String("error", err.Error()),
+					),
+				)
+			}
+		}
+	}
+}
+
+func (b *zmqBridge) close() error {
+	close(b.stop)
+	b.wg.Wait()
+	return b.closeSockets()
+}
+
+func (b *zmqBridge) closeSockets() error {
+	var errs []error
+
+	if b.ingest != nil {
+		if err := b.ingest.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close ingest socket: %w", err))
+		}
+		b.ingest = nil
+	}
+	if b.egress != nil {
+		if err := b.egress.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close egress socket: %w", err))
+		}
+		b.egress = nil
+	}
+	if b.context != nil {
+		if err := b.context.Term(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to terminate context: %w", err))
+		}
+		b.context = nil
+	}
+
+	return errors.Join(errs...)
+}
+
+// start the persisted bridge of a restored endpoint
+func (e *BroadcastEndpoint) restoreBridge() {
+	e.mu.Lock()
+	config := e.zmq
+	e.mu.Unlock()
+
+	if config == nil {
+		return
+	}
+
+	e.bridgeMu.Lock()
+	defer e.bridgeMu.Unlock()
+
+	bridge, err := startBridge(e, *config)
+	if err != nil {
+		logger.Logger.Error(
+			"failed to restore zmq bridge: ",
+			slog.Group(
+				logKey,
+				slog.String("endpoint", e.name),
+				slog.String("error", err.Error()),
+			),
+		)
+		return
+	}
+	e.bridge = bridge
+}
+
+// replace the running bridge of the endpoint, a nil config only stops it
+func (e *BroadcastEndpoint) setBridge(config *ZMQBridge) error {
+	e.bridgeMu.Lock()
+	defer e.bridgeMu.Unlock()
+
+	if e.bridge != nil {
+		if err := e.bridge.close(); err != nil {
+			logger.Logger.Warn(
+				"failed to close zmq bridge: ",
+				slog.Group(
+					logKey,
+					slog.String("endpoint", e.name),
+					slog.String("error", err.Error()),
+				),
+			)
+		}
+		e.bridge = nil
+	}
+
+	var err error
+	if config != nil {
+		e.bridge, err = startBridge(e, *config)
+		if err != nil {
+			// persist that no bridge is running anymore
+			config = nil
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.zmq = config
+	return errors.Join(err, e.saveMetaLocked())
+}
+
+// Configure the ZeroMQ bridge of the broadcast endpoint
+func SetBroadcastBridge(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	var config ZMQBridge
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid zmq bridge config",
+			Detail: err.Error(),
+		})
+		return
+	}
+	if err := config.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid zmq bridge config",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	if err := endpoint.setBridge(&config); err != nil {
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to start zmq bridge for endpoint: %s", name),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, config)
+}
+
+// Stop the ZeroMQ bridge of the broadcast endpoint
+func DeleteBroadcastBridge(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	if err := endpoint.setBridge(nil); err != nil {
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to stop zmq bridge for endpoint: %s", name),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
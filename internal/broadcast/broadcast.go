@@ -2,43 +2,385 @@ package broadcast
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math"
 	"math/rand"
 	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Ccccraz/cogmoteGO/internal/commonTypes"
+	"github.com/Ccccraz/cogmoteGO/internal/config"
 	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	"github.com/Ccccraz/cogmoteGO/internal/mainpath"
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
+	"github.com/santhosh-tekuri/jsonschema/v6"
 )
 
 var (
 	logKey = "broadcast"
 )
 
+// single payload published to a broadcast endpoint
+type message struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Data []byte    `json:"data"`
+	// Content-Type of the payload, empty for JSON
+	ContentType string `json:"content_type,omitempty"`
+}
+
 // broadcast endpoint
 type BroadcastEndpoint struct {
-	mu          sync.Mutex    // mutex to protect subscribers
-	subscribers []chan []byte // all subscribers
-	history     [][]byte      // history of data
+	name         string             // name of the endpoint
+	description  string             // what the endpoint carries
+	owner        string             // id of the experiment owning the endpoint
+	created      time.Time          // creation time of the endpoint
+	idleTTL      int64              // seconds of inactivity before deletion
+	lastPublish  time.Time          // time of the latest publish
+	lastActive   time.Time          // time of the latest publish or subscriber change
+	mu           sync.Mutex         // mutex to protect subscribers and history
+	fanoutMu     sync.Mutex         // mutex to keep deliveries in publish order
+	subscribers  []*subscriber      // all subscribers
+	nextSubID    uint64             // id of the next subscriber
+	dropped      atomic.Uint64      // messages dropped for slow subscribers
+	backpressure Backpressure       // slow subscriber policy
+	history      []message          // retained history of data
+	historySize  int64              // total payload bytes in history
+	lastSeq      uint64             // sequence number of the latest message
+	retention    Retention          // history retention policy
+	schema       SchemaConfig       // schema published data must match
+	validator    *jsonschema.Schema // compiled inline schema, nil without one
+	aggregators  []*aggregator      // rolling aggregations of the data
+	alerts       []*alert           // alert rules on the data
+	recorder     *recorder          // running recording, nil if not recording
+	log          *segmentLog        // on-disk copy of history
+	zmq          *ZMQBridge         // zmq bridge config, nil if disabled
+	bridgeMu     sync.Mutex         // mutex to serialize bridge restarts
+	bridge       *zmqBridge         // running zmq bridge
 }
 
 var (
 	broadEndpoints   = make(map[string]*BroadcastEndpoint) // all broadcast endpoints
 	broadEndpointsMu sync.RWMutex                          // mutex to protect broadcast endpoints
+	cfg              config.Config
 )
 
-// add default data endpoint
-func init() {
-	broadEndpoints["default"] = &BroadcastEndpoint{
-		subscribers: make([]chan []byte, 0),
+// Restore persisted endpoints and add the default data endpoint
+func Init(config config.Config) {
+	cfg = config
+	storeDir = filepath.Join(mainpath.DataPath, "broadcast")
+
+	logger.Logger.Debug(
+		"location of broadcast store: ",
+		slog.Group(
+			logKey,
+			slog.String("location", storeDir),
+		),
+	)
+
+	loadSchemas()
+	loadEndpoints()
+	loadRelays()
+	go reapIdleEndpoints()
+	go watchAlerts()
+
+	broadEndpointsMu.Lock()
+	defer broadEndpointsMu.Unlock()
+
+	if _, exists := broadEndpoints["default"]; exists {
+		return
+	}
+
+	endpoint, err := newEndpoint(endpointMeta{Name: "default"})
+	if err != nil {
+		logger.Logger.Error(
+			"failed to persist default endpoint, keeping it in memory only: ",
+			slog.Group(
+				logKey,
+				slog.String("error", err.Error()),
+			),
+		)
+		endpoint = &BroadcastEndpoint{
+			name:        "default",
+			created:     time.Now(),
+			lastActive:  time.Now(),
+			subscribers: make([]*subscriber, 0),
+		}
+	}
+	broadEndpoints["default"] = endpoint
+}
+
+func newEndpoint(meta endpointMeta) (*BroadcastEndpoint, error) {
+	now := time.Now()
+	if meta.Created.IsZero() {
+		// new endpoint, or persisted before creation times were kept
+		meta.Created = now
+	}
+
+	dir := endpointDir(meta.Name)
+	if err := saveEndpointMeta(dir, meta); err != nil {
+		return nil, err
+	}
+
+	var compiled *jsonschema.Schema
+	if len(meta.Schema.Schema) > 0 {
+		var err error
+		compiled, err = compileSchema(meta.Schema.Schema)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log, history, err := openSegmentLog(dir, cfg.Broadcast.SegmentBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := &BroadcastEndpoint{
+		name:         meta.Name,
+		description:  meta.Description,
+		owner:        meta.Owner,
+		created:      meta.Created,
+		idleTTL:      meta.IdleTTL,
+		lastActive:   now,
+		subscribers:  make([]*subscriber, 0),
+		backpressure: meta.Backpressure,
+		lastSeq:      log.next - 1,
+		retention:    meta.Retention,
+		schema:       meta.Schema,
+		validator:    compiled,
+		log:          log,
+		zmq:          meta.ZMQ,
+	}
+	for _, msg := range history {
+		endpoint.history = append(endpoint.history, msg)
+		endpoint.historySize += int64(len(msg.Data))
+		endpoint.lastPublish = msg.Time
+	}
+	endpoint.trimLocked(now)
+
+	for _, config := range meta.Aggregations {
+		a, err := newAggregator(config)
+		if err != nil {
+			logger.Logger.Error(
+				"failed to restore aggregation: ",
+				slog.Group(
+					logKey,
+					slog.String("endpoint", meta.Name),
+					slog.String("aggregation", config.Name),
+					slog.String("error", err.Error()),
+				),
+			)
+			continue
+		}
+		endpoint.seedLocked(a)
+		endpoint.aggregators = append(endpoint.aggregators, a)
+	}
+	for _, rule := range meta.Alerts {
+		a, err := newAlert(rule)
+		if err != nil {
+			logger.Logger.Error(
+				"failed to restore alert: ",
+				slog.Group(
+					logKey,
+					slog.String("endpoint", meta.Name),
+					slog.String("alert", rule.Name),
+					slog.String("error", err.Error()),
+				),
+			)
+			continue
+		}
+		endpoint.seedLocked(a.agg)
+		endpoint.alerts = append(endpoint.alerts, a)
+	}
+	endpoint.restoreRecorderLocked(meta.Recording)
+
+	return endpoint, nil
+}
+
+func (e *BroadcastEndpoint) metaLocked() endpointMeta {
+	return endpointMeta{
+		Name:         e.name,
+		Description:  e.description,
+		Owner:        e.owner,
+		Created:      e.created,
+		IdleTTL:      e.idleTTL,
+		Retention:    e.retention,
+		Backpressure: e.backpressure,
+		Schema:       e.schema,
+		Aggregations: e.aggregationsLocked(),
+		Alerts:       e.alertRulesLocked(),
+		Recording:    e.recordingLocked(),
+		ZMQ:          e.zmq,
+	}
+}
+
+func (e *BroadcastEndpoint) saveMetaLocked() error {
+	if e.log == nil {
+		// in memory or removed endpoint
+		return nil
+	}
+	return saveEndpointMeta(endpointDir(e.name), e.metaLocked())
+}
+
+// load every endpoint persisted under the broadcast store
+func loadEndpoints() {
+	entries, err := os.ReadDir(storeDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Logger.Error(
+				"failed to read broadcast store: ",
+				slog.Group(
+					logKey,
+					slog.String("error", err.Error()),
+				),
+			)
+		}
+		return
+	}
+
+	broadEndpointsMu.Lock()
+	defer broadEndpointsMu.Unlock()
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		meta, err := loadEndpointMeta(filepath.Join(storeDir, entry.Name()))
+		if err == nil {
+			var endpoint *BroadcastEndpoint
+			endpoint, err = newEndpoint(meta)
+			if err == nil {
+				broadEndpoints[meta.Name] = endpoint
+				endpoint.restoreBridge()
+				continue
+			}
+		}
+
+		logger.Logger.Error(
+			"failed to restore broadcast endpoint: ",
+			slog.Group(
+				logKey,
+				slog.String("dir", entry.Name()),
+				slog.String("error", err.Error()),
+			),
+		)
+	}
+}
+
+// append data to the history and its on-disk log, then apply retention
+func (e *BroadcastEndpoint) appendLocked(data []byte, contentType string) message {
+	if contentType == contentTypeJSON {
+		contentType = ""
+	}
+
+	e.lastSeq++
+	msg := message{
+		Seq:         e.lastSeq,
+		Time:        time.Now(),
+		Data:        data,
+		ContentType: contentType,
+	}
+
+	if e.log != nil {
+		if err := e.log.append(msg); err != nil {
+			logger.Logger.Warn(
+				"failed to persist broadcast data: ",
+				slog.Group(
+					logKey,
+					slog.String("error", err.Error()),
+				),
+			)
+		}
 	}
+
+	e.history = append(e.history, msg)
+	e.historySize += int64(len(data))
+	e.lastPublish = msg.Time
+	e.touchLocked(msg.Time)
+	e.trimLocked(msg.Time)
+
+	return msg
 }
 
+// drop history that falls outside the retention policy
+func (e *BroadcastEndpoint) trimLocked(now time.Time) {
+	n := e.retention.withDefaults().expired(e.history, e.historySize, now)
+	if n == 0 {
+		return
+	}
+
+	for _, msg := range e.history[:n] {
+		e.historySize -= int64(len(msg.Data))
+	}
+	clear(e.history[:n])
+	e.history = e.history[n:]
+
+	if e.log != nil {
+		e.log.discard(n)
+	}
+}
+
+// close the endpoint and delete its persisted history
+func (e *BroadcastEndpoint) remove() error {
+	e.bridgeMu.Lock()
+	if e.bridge != nil {
+		_ = e.bridge.close()
+		e.bridge = nil
+	}
+	e.bridgeMu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, a := range e.aggregators {
+		a.close()
+	}
+	if err := e.stopRecorderLocked(); err != nil {
+		logger.Logger.Warn(
+			"failed to close recording: ",
+			slog.Group(
+				logKey,
+				slog.String("endpoint", e.name),
+				slog.String("error", err.Error()),
+			),
+		)
+	}
+
+	if e.log == nil {
+		return nil
+	}
+	if err := e.log.close(); err != nil {
+		return err
+	}
+	e.log = nil
+
+	dir := endpointDir(e.name)
+	if !insideStore(dir) {
+		return fmt.Errorf("refusing to delete %s outside of the broadcast store", dir)
+	}
+	return os.RemoveAll(dir)
+}
+
+// list the names of all endpoints, or their metadata with ?detail=true
 func GetBroadcasts(c *gin.Context) {
+	if detail, _ := strconv.ParseBool(c.Query("detail")); detail {
+		c.JSON(http.StatusOK, gin.H{
+			"broadcast_endpoints": endpointInfos(),
+		})
+		return
+	}
+
 	broadEndpointsMu.RLock()
 	defer broadEndpointsMu.RUnlock()
 
@@ -55,7 +397,14 @@ func GetBroadcasts(c *gin.Context) {
 // create new data broadcast endpoint
 func CreateBroadcast(c *gin.Context) {
 	var request struct {
-		Name string `json:"name" binding:"required"`
+		Name         string       `json:"name" binding:"required"`
+		Description  string       `json:"description"`
+		Owner        string       `json:"owner"`
+		IdleTTL      int64        `json:"idle_ttl"`
+		Retention    Retention    `json:"retention"`
+		Backpressure Backpressure `json:"backpressure"`
+		ZMQ          *ZMQBridge   `json:"zmq"`
+		SchemaConfig
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -66,6 +415,48 @@ func CreateBroadcast(c *gin.Context) {
 		return
 	}
 
+	if err := validateEndpointName(request.Name); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "without valid broadcast name",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	if request.IdleTTL < 0 {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid idle ttl",
+			Detail: "idle_ttl must not be negative",
+		})
+		return
+	}
+
+	if err := request.Backpressure.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid backpressure config",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	if _, err := request.SchemaConfig.compile(); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid schema config",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	if request.ZMQ != nil {
+		if err := request.ZMQ.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, commonTypes.APIError{
+				Error:  "invalid zmq bridge config",
+				Detail: err.Error(),
+			})
+			return
+		}
+	}
+
 	broadEndpointsMu.Lock()
 	defer broadEndpointsMu.Unlock()
 
@@ -76,14 +467,49 @@ func CreateBroadcast(c *gin.Context) {
 		})
 		return
 	}
+	if reapingEndpoints[request.Name] {
+		c.JSON(http.StatusConflict, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s is being deleted", request.Name),
+			Detail: "retry once its idle TTL cleanup finished",
+		})
+		return
+	}
 
-	broadEndpoints[request.Name] = &BroadcastEndpoint{
-		subscribers: make([]chan []byte, 0),
+	endpoint, err := newEndpoint(endpointMeta{
+		Name:         request.Name,
+		Description:  request.Description,
+		Owner:        request.Owner,
+		IdleTTL:      request.IdleTTL,
+		Retention:    request.Retention,
+		Backpressure: request.Backpressure,
+		Schema:       request.SchemaConfig,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to create data broadcast endpoint: %s", request.Name),
+			Detail: err.Error(),
+		})
+		return
 	}
+
+	if request.ZMQ != nil {
+		if err := endpoint.setBridge(request.ZMQ); err != nil {
+			_ = endpoint.remove()
+			c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+				Error:  fmt.Sprintf("failed to start zmq bridge for endpoint: %s", request.Name),
+				Detail: err.Error(),
+			})
+			return
+		}
+	}
+
+	broadEndpoints[request.Name] = endpoint
 	c.Status(http.StatusCreated)
 }
 
-// broadcast data to all subscribers when data update
+// broadcast data to all subscribers when data update, the Content-Type of
+// the request is kept with the data. NDJSON bodies and JSON arrays posted
+// with ?batch=true are published as one message per line or element.
 func BroadcastData(c *gin.Context) {
 	name := c.Param("name")
 
@@ -109,35 +535,65 @@ func BroadcastData(c *gin.Context) {
 		return
 	}
 
-	endpoint.mu.Lock()
-	wg := sync.WaitGroup{}
-	for _, ch := range endpoint.subscribers {
-		wg.Add(1)
-		go func(c chan []byte) {
-			defer wg.Done()
+	contentType := parseContentType(c.GetHeader("Content-Type"))
+	if batch, _ := strconv.ParseBool(c.Query("batch")); batch || isNDJSON(contentType) {
+		broadcastBatch(c, endpoint, data, contentType)
+		return
+	}
 
-			select {
-			case c <- data:
-			default:
-				logger.Logger.Warn(
-					"channel is full: ",
-					slog.Group(
-						logKey,
-						slog.String("endpoint", name),
-					))
-			}
-		}(ch)
+	if _, err := endpoint.publish(data, contentType); err != nil {
+		var schemaErr *schemaError
+		if errors.As(err, &schemaErr) {
+			c.JSON(http.StatusUnprocessableEntity, commonTypes.APIError{
+				Error:  schemaErr.reason,
+				Detail: schemaErr.detail,
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to publish data to endpoint: %s", name),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
 
+// check data against the schema of the endpoint, then store it in the
+// history and fan it out to all subscribers
+func (e *BroadcastEndpoint) publish(data []byte, contentType string) (message, error) {
+	msgs, err := e.publishBatch([][]byte{data}, contentType)
+	if err != nil {
+		return message{}, err
 	}
-	wg.Wait()
-	endpoint.mu.Unlock()
+	return msgs[0], nil
+}
 
-	endpoint.history = append(endpoint.history, data)
+// ErrEndpointNotFound is returned by Publish for an unknown endpoint
+var ErrEndpointNotFound = errors.New("data broadcast endpoint does not exist")
 
-	c.Status(http.StatusOK)
+// Publish data to the endpoint name like a POST to /broadcast/data/:name
+// and return its sequence number. Data rejected by the schema of the
+// endpoint matches ErrSchemaViolation.
+func Publish(name string, data []byte, contentType string) (uint64, error) {
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		return 0, fmt.Errorf("%w: %s", ErrEndpointNotFound, name)
+	}
+
+	msg, err := endpoint.publish(data, contentType)
+	if err != nil {
+		return 0, err
+	}
+	return msg.Seq, nil
 }
 
-// Subscribe to the broadcast endpoint and receive updates via Server-Sent Events (SSE)
+// Subscribe to the broadcast endpoint and receive updates via Server-Sent Events (SSE),
+// optionally narrowed down with the filter and fields query parameters
 func SubscribeBroadcast(c *gin.Context) {
 	name := c.Param("name")
 
@@ -153,43 +609,55 @@ func SubscribeBroadcast(c *gin.Context) {
 		return
 	}
 
-	endpoint.mu.Lock()
-
-	// send history data
-	if len(endpoint.history) > 0 {
-		for _, data := range endpoint.history {
-			c.SSEvent("message", data)
-			c.Writer.Flush()
-		}
+	opts, err := parseReplayOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid replay options",
+			Detail: err.Error(),
+		})
+		return
 	}
 
-	// create new subscriber channel
-	ch := make(chan []byte, 10)
+	view, err := parseDataView(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid data view",
+			Detail: err.Error(),
+		})
+		return
+	}
 
-	// add subscriber to the endpoint
-	endpoint.subscribers = append(endpoint.subscribers, ch)
-	endpoint.mu.Unlock()
+	replay, sub := endpoint.subscribe(opts, "sse", c.ClientIP())
+	defer endpoint.unsubscribe(sub)
 
-	// listen for data updates and send them to the subscriber
-	defer func() {
-		// remove subscriber from the endpoint
-		endpoint.mu.Lock()
-		defer endpoint.mu.Unlock()
-		for i, sub := range endpoint.subscribers {
-			if sub == ch {
-				endpoint.subscribers = append(endpoint.subscribers[:i], endpoint.subscribers[i+1:]...)
-				break
-			}
+	// send history data
+	var lastSent uint64
+	for _, msg := range replay {
+		lastSent = msg.Seq
+		if msg, ok := view.apply(msg); ok {
+			writeSSEvent(c, msg)
 		}
-		close(ch)
-	}()
+	}
+	c.Writer.Flush()
 
+	// listen for data updates and send them to the subscriber
 	for {
 		select {
-		case data := <-ch:
+		case msg := <-sub.ch:
+			if msg.Seq <= lastSent {
+				continue
+			}
+			lastSent = msg.Seq
+			msg, ok := view.apply(msg)
+			if !ok {
+				continue
+			}
 			// send data by SSE
-			c.SSEvent("message", data)
+			writeSSEvent(c, msg)
 			c.Writer.Flush()
+		case <-sub.done:
+			// disconnected by the backpressure policy
+			return
 		case <-c.Writer.CloseNotify():
 			// close subscriber channel
 			return
@@ -197,6 +665,74 @@ func SubscribeBroadcast(c *gin.Context) {
 	}
 }
 
+// register a new subscriber and return the history it should be replayed
+// first
+func (e *BroadcastEndpoint) subscribe(opts replayOptions, transport string, remote string) ([]message, *subscriber) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.trimLocked(time.Now())
+	replay := slices.Clone(opts.apply(e.history))
+
+	// create new subscriber channel
+	e.nextSubID++
+	sub := &subscriber{
+		id:          e.nextSubID,
+		transport:   transport,
+		remote:      remote,
+		connectedAt: time.Now(),
+		ch:          make(chan message, e.backpressure.withDefaults().BufferSize),
+		done:        make(chan struct{}),
+	}
+
+	// add subscriber to the endpoint
+	e.subscribers = append(e.subscribers, sub)
+	if !sub.internal() {
+		e.touchLocked(sub.connectedAt)
+	}
+
+	return replay, sub
+}
+
+// remove subscriber from the endpoint
+func (e *BroadcastEndpoint) unsubscribe(sub *subscriber) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i, s := range e.subscribers {
+		if s == sub {
+			e.subscribers = append(e.subscribers[:i], e.subscribers[i+1:]...)
+			if !sub.internal() {
+				e.touchLocked(time.Now())
+			}
+			break
+		}
+	}
+	sub.close()
+}
+
+// write msg as an SSE event carrying its sequence number as id, binary
+// payloads are sent base64 encoded as binary events
+func writeSSEvent(c *gin.Context, msg message) {
+	if !msg.isText() {
+		c.Render(-1, sse.Event{
+			Id:    strconv.FormatUint(msg.Seq, 10),
+			Event: "binary",
+			Data: binaryEvent{
+				ContentType: msg.contentType(),
+				Data:        msg.Data,
+			},
+		})
+		return
+	}
+
+	c.Render(-1, sse.Event{
+		Id:    strconv.FormatUint(msg.Seq, 10),
+		Event: "message",
+		Data:  msg.Data,
+	})
+}
+
 func GetLatestData(c *gin.Context) {
 	name := c.Param("name")
 	broadEndpointsMu.RLock()
@@ -209,18 +745,30 @@ func GetLatestData(c *gin.Context) {
 		})
 		return
 	}
-	endpoint.mu.Lock()
-	defer endpoint.mu.Unlock()
-	if len(endpoint.history) == 0 {
-		c.JSON(http.StatusNotFound, commonTypes.APIError{
-			Error:  fmt.Sprintf("no data available in endpoint: %s", name),
-			Detail: "",
+	view, err := parseDataView(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid data view",
+			Detail: err.Error(),
 		})
 		return
 	}
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+	endpoint.trimLocked(time.Now())
+
+	// latest message that passes the filter
+	for i := len(endpoint.history) - 1; i >= 0; i-- {
+		if latest, ok := view.apply(endpoint.history[i]); ok {
+			c.Data(http.StatusOK, latest.contentType(), latest.Data)
+			return
+		}
+	}
 
-	latestData := endpoint.history[len(endpoint.history)-1]
-	c.Data(http.StatusOK, "application/json", latestData)
+	c.JSON(http.StatusNotFound, commonTypes.APIError{
+		Error:  fmt.Sprintf("no data available in endpoint: %s", name),
+		Detail: "",
+	})
 }
 
 type MockTrialData struct {
@@ -338,7 +886,8 @@ func DeleteBroadcast(c *gin.Context) {
 	broadEndpointsMu.Lock()
 	defer broadEndpointsMu.Unlock()
 
-	if _, exists := broadEndpoints[name]; !exists {
+	endpoint, exists := broadEndpoints[name]
+	if !exists {
 		c.JSON(http.StatusNotFound, commonTypes.APIError{
 			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
 			Detail: "",
@@ -348,6 +897,17 @@ func DeleteBroadcast(c *gin.Context) {
 
 	delete(broadEndpoints, name)
 
+	if err := endpoint.remove(); err != nil {
+		logger.Logger.Warn(
+			"failed to remove broadcast history: ",
+			slog.Group(
+				logKey,
+				slog.String("endpoint", name),
+				slog.String("error", err.Error()),
+			),
+		)
+	}
+
 	c.Status(http.StatusOK)
 }
 
@@ -370,11 +930,53 @@ func RegisterRoutes(r gin.IRouter) {
 		c.Params = append(c.Params, gin.Param{Key: "name", Value: "default"})
 		BroadcastData(c)
 	})
+	r.GET("/broadcast/data/default/ws", func(c *gin.Context) {
+		c.Params = append(c.Params, gin.Param{Key: "name", Value: "default"})
+		WebSocketBroadcast(c)
+	})
 
 	r.GET("/broadcast/data/:name", headersMiddleware(), SubscribeBroadcast)
 	r.GET("/broadcast/data/:name/latest", GetLatestData)
 	r.POST("/broadcast/data/:name", BroadcastData)
+	r.POST("/broadcast/data/:name/stream", StreamBroadcastData)
+	r.GET("/broadcast/data/:name/ws", WebSocketBroadcast)
 	r.DELETE("/broadcast/data/:name", DeleteBroadcast)
+	r.GET("/broadcast/data/:name/info", GetBroadcastInfo)
+
+	r.GET("/broadcast/data/:name/subscribers", GetBroadcastSubscribers)
+	r.PUT("/broadcast/data/:name/backpressure", SetBroadcastBackpressure)
+	r.PUT("/broadcast/data/:name/zmq", SetBroadcastBridge)
+	r.DELETE("/broadcast/data/:name/zmq", DeleteBroadcastBridge)
+	r.PUT("/broadcast/data/:name/schema", SetBroadcastSchema)
+	r.DELETE("/broadcast/data/:name/schema", DeleteBroadcastSchema)
+
+	r.GET("/broadcast/data/:name/aggregates", GetAggregates)
+	r.POST("/broadcast/data/:name/aggregates", CreateAggregate)
+	r.GET("/broadcast/data/:name/aggregates/:aggregate", GetAggregate)
+	r.GET("/broadcast/data/:name/aggregates/:aggregate/stream", headersMiddleware(), SubscribeAggregate)
+	r.DELETE("/broadcast/data/:name/aggregates/:aggregate", DeleteAggregate)
+
+	r.GET("/broadcast/data/:name/alerts", GetBroadcastAlerts)
+	r.POST("/broadcast/data/:name/alerts", CreateBroadcastAlert)
+	r.GET("/broadcast/data/:name/alerts/:alert", GetBroadcastAlert)
+	r.POST("/broadcast/data/:name/alerts/:alert/ack", AcknowledgeBroadcastAlert)
+	r.DELETE("/broadcast/data/:name/alerts/:alert", DeleteBroadcastAlert)
+
+	r.GET("/broadcast/data/:name/recording", GetRecording)
+	r.POST("/broadcast/data/:name/recording", StartRecording)
+	r.DELETE("/broadcast/data/:name/recording", StopRecording)
+
+	r.GET("/broadcast/alerts", GetAlerts)
+
+	r.GET("/broadcast/relays", GetRelays)
+	r.POST("/broadcast/relays", CreateRelay)
+	r.GET("/broadcast/relays/:relay", GetRelay)
+	r.DELETE("/broadcast/relays/:relay", DeleteRelay)
+
+	r.GET("/broadcast/schemas", GetSchemas)
+	r.GET("/broadcast/schemas/:name", GetSchema)
+	r.PUT("/broadcast/schemas/:name", PutSchema)
+	r.DELETE("/broadcast/schemas/:name", DeleteSchema)
 }
 
 func headersMiddleware() gin.HandlerFunc {
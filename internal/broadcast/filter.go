@@ -0,0 +1,544 @@
+package broadcast
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dataView selects the messages and fields a subscriber receives, parsed
+// from the filter, fields and format query parameters:
+//
+//	?filter=result == "correct" && correct_rate >= 0.5
+//	?fields=trial_id,correct_rate
+//	?format=json
+//
+// Filters and projections only apply to JSON and MessagePack payloads, and
+// their results are JSON. Other payloads never match a filter and are passed
+// through unchanged by a projection. format=json transcodes MessagePack
+// payloads to JSON.
+type dataView struct {
+	filter    filterNode // nil matches every message
+	fields    [][]string // dotted paths to keep, nil keeps the whole payload
+	transcode bool       // whether MessagePack payloads are sent as JSON
+}
+
+// parse the filter, fields and format query parameters, nil means no view
+// was asked for
+func parseDataView(c *gin.Context) (*dataView, error) {
+	var view dataView
+
+	if raw := c.Query("filter"); raw != "" {
+		filter, err := parseFilter(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter: %w", err)
+		}
+		view.filter = filter
+	}
+
+	if raw := c.Query("fields"); raw != "" {
+		for _, field := range strings.Split(raw, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			view.fields = append(view.fields, strings.Split(field, "."))
+		}
+	}
+
+	switch format := c.Query("format"); format {
+	case "":
+	case "json":
+		view.transcode = true
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+
+	if view.filter == nil && view.fields == nil && !view.transcode {
+		return nil, nil
+	}
+	return &view, nil
+}
+
+// apply the view to msg, reporting whether the subscriber wants it at all
+func (v *dataView) apply(msg message) (message, bool) {
+	if v == nil {
+		return msg, true
+	}
+
+	if v.filter == nil && v.fields == nil {
+		if v.transcode && msg.isMsgPack() {
+			if data, ok := msg.asJSON(); ok {
+				msg.Data, msg.ContentType = data, ""
+			}
+		}
+		return msg, true
+	}
+
+	doc, ok := msg.decode()
+	if !ok {
+		return msg, v.filter == nil
+	}
+
+	if v.filter != nil && !truthy(v.filter.eval(doc)) {
+		return msg, false
+	}
+
+	if object, ok := doc.(map[string]any); ok && v.fields != nil {
+		data, err := json.Marshal(project(object, v.fields))
+		if err == nil {
+			msg.Data, msg.ContentType = data, ""
+		}
+	} else if v.transcode && msg.isMsgPack() {
+		data, err := json.Marshal(doc)
+		if err == nil {
+			msg.Data, msg.ContentType = data, ""
+		}
+	}
+
+	return msg, true
+}
+
+// copy only the given paths of object, missing paths are left out
+func project(object map[string]any, fields [][]string) map[string]any {
+	result := make(map[string]any)
+
+	for _, path := range fields {
+		value, ok := lookup(object, path)
+		if !ok {
+			continue
+		}
+
+		target := result
+		for _, key := range path[:len(path)-1] {
+			next, ok := target[key].(map[string]any)
+			if !ok {
+				next = make(map[string]any)
+				target[key] = next
+			}
+			target = next
+		}
+		target[path[len(path)-1]] = value
+	}
+
+	return result
+}
+
+// resolve a dotted path, numeric elements index into arrays
+func lookup(doc any, path []string) (any, bool) {
+	for _, key := range path {
+		switch node := doc.(type) {
+		case map[string]any:
+			value, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			doc = value
+		case []any:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			doc = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// node of a parsed filter expression, evaluated against a decoded payload
+type filterNode interface {
+	eval(doc any) any
+}
+
+type literalNode struct{ value any }
+
+type pathNode struct{ path []string }
+
+type notNode struct{ operand filterNode }
+
+type logicalNode struct {
+	op          string
+	left, right filterNode
+}
+
+type compareNode struct {
+	op          string
+	left, right filterNode
+}
+
+func (n literalNode) eval(any) any { return n.value }
+
+func (n pathNode) eval(doc any) any {
+	value, _ := lookup(doc, n.path)
+	return value
+}
+
+func (n notNode) eval(doc any) any { return !truthy(n.operand.eval(doc)) }
+
+func (n logicalNode) eval(doc any) any {
+	left := truthy(n.left.eval(doc))
+	if n.op == "&&" {
+		return left && truthy(n.right.eval(doc))
+	}
+	return left || truthy(n.right.eval(doc))
+}
+
+func (n compareNode) eval(doc any) any {
+	left, right := n.left.eval(doc), n.right.eval(doc)
+
+	switch n.op {
+	case "==":
+		return equal(left, right)
+	case "!=":
+		return !equal(left, right)
+	}
+
+	cmp, ok := compare(left, right)
+	if !ok {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+func truthy(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	default:
+		return true
+	}
+}
+
+func equal(left, right any) bool {
+	switch l := left.(type) {
+	case nil:
+		return right == nil
+	case bool:
+		r, ok := right.(bool)
+		return ok && l == r
+	case float64:
+		r, ok := right.(float64)
+		return ok && l == r
+	case string:
+		r, ok := right.(string)
+		return ok && l == r
+	default:
+		// objects and arrays only compare by their JSON encoding
+		l1, err1 := json.Marshal(left)
+		r1, err2 := json.Marshal(right)
+		return err1 == nil && err2 == nil && string(l1) == string(r1)
+	}
+}
+
+// order two numbers or two strings
+func compare(left, right any) (int, bool) {
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case l < r:
+			return -1, true
+		case l > r:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(l, r), true
+	}
+	return 0, false
+}
+
+// parseFilter parses expressions of the form
+//
+//	expr    = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | operand [ op operand ]
+//	op      = "==" | "!=" | "<" | "<=" | ">" | ">="
+//	operand = path | string | number | true | false | null | "(" expr ")"
+//
+// where a path is a dotted field name such as trial.result, and a path on
+// its own is true when the field is present and not false, zero or empty.
+// Strings in single or double quotes take the escapes of Go strings.
+// Parentheses and negations nest at most maxFilterDepth deep.
+func parseFilter(input string) (filterNode, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return node, nil
+}
+
+type tokenKind int
+
+const (
+	tokenPath tokenKind = iota
+	tokenString
+	tokenNumber
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(input); {
+		ch, size := utf8.DecodeRuneInString(input[i:])
+
+		switch {
+		case unicode.IsSpace(ch):
+			i += size
+		case strings.HasPrefix(input[i:], "==") || strings.HasPrefix(input[i:], "!=") ||
+			strings.HasPrefix(input[i:], "<=") || strings.HasPrefix(input[i:], ">=") ||
+			strings.HasPrefix(input[i:], "&&") || strings.HasPrefix(input[i:], "||"):
+			tokens = append(tokens, token{kind: tokenOp, text: input[i : i+2]})
+			i += 2
+		case strings.ContainsRune("<>!()", ch):
+			tokens = append(tokens, token{kind: tokenOp, text: input[i : i+1]})
+			i++
+		case ch == '"' || ch == '\'':
+			end := i + 1
+			for end < len(input) && input[end] != input[i] {
+				if input[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(input) {
+				return nil, errors.New("unterminated string")
+			}
+			text, err := unquote(input[i+1:end], byte(ch))
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s", input[i:end+1])
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text})
+			i = end + 1
+		case ch == '-' || ch == '.' || unicode.IsDigit(ch):
+			end := i + 1
+			for end < len(input) && strings.ContainsRune("0123456789.eE+-", rune(input[end])) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: input[i:end]})
+			i = end
+		case ch == '_' || unicode.IsLetter(ch):
+			end := i + size
+			for end < len(input) {
+				next, size := utf8.DecodeRuneInString(input[end:])
+				if next != '_' && next != '.' && !unicode.IsLetter(next) && !unicode.IsDigit(next) {
+					break
+				}
+				end += size
+			}
+			tokens = append(tokens, token{kind: tokenPath, text: input[i:end]})
+			i = end
+		default:
+			return nil, fmt.Errorf("unexpected character %q", ch)
+		}
+	}
+
+	return tokens, nil
+}
+
+// unescape the body of a string quoted with quote
+func unquote(body string, quote byte) (string, error) {
+	var b strings.Builder
+	for body != "" {
+		value, multibyte, tail, err := strconv.UnquoteChar(body, quote)
+		if err != nil {
+			return "", err
+		}
+		if value < utf8.RuneSelf || !multibyte {
+			b.WriteByte(byte(value))
+		} else {
+			b.WriteRune(value)
+		}
+		body = tail
+	}
+	return b.String(), nil
+}
+
+// deepest nesting of parentheses and negations in a filter, so the
+// recursion of the parser stays bounded whatever the query
+const maxFilterDepth = 64
+
+type filterParser struct {
+	tokens []token
+	pos    int
+	depth  int
+}
+
+// enter a parenthesized or negated expression
+func (p *filterParser) nest() error {
+	p.depth++
+	if p.depth > maxFilterDepth {
+		return fmt.Errorf("filter nested deeper than %d levels", maxFilterDepth)
+	}
+	return nil
+}
+
+func (p *filterParser) peekOp(ops ...string) (string, bool) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].text == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOp("||"); !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{op: "||", left: left, right: right}
+	}
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOp("&&"); !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{op: "&&", left: left, right: right}
+	}
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if _, ok := p.peekOp("!"); ok {
+		p.pos++
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		p.depth--
+		return notNode{operand: operand}, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.peekOp("==", "!=", "<", "<=", ">", ">=")
+	if !ok {
+		return left, nil
+	}
+	p.pos++
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return compareNode{op: op, left: left, right: right}, nil
+}
+
+func (p *filterParser) parseOperand() (filterNode, error) {
+	if _, ok := p.peekOp("("); ok {
+		p.pos++
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.peekOp(")"); !ok {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		p.depth--
+		return node, nil
+	}
+
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of filter")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+
+	switch tok.kind {
+	case tokenString:
+		return literalNode{value: tok.text}, nil
+	case tokenNumber:
+		number, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", tok.text)
+		}
+		return literalNode{value: number}, nil
+	case tokenPath:
+		switch tok.text {
+		case "true":
+			return literalNode{value: true}, nil
+		case "false":
+			return literalNode{value: false}, nil
+		case "null":
+			return literalNode{value: nil}, nil
+		}
+		return pathNode{path: strings.Split(tok.text, ".")}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", tok.text)
+}
@@ -0,0 +1,240 @@
+package broadcast
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestParseFilter(t *testing.T) {
+	doc := map[string]any{
+		"result":       "correct",
+		"correct_rate": 0.75,
+		"trial":        map[string]any{"id": 12.0, "blocks": []any{"a", "b"}},
+		"done":         false,
+		"note":         "",
+		"missing_val":  nil,
+		"quote":        `it's "fine"`,
+		"größe":        3.0,
+	}
+
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{`result == "correct"`, true},
+		{`result == 'correct'`, true},
+		{`result != "correct"`, false},
+		{`correct_rate >= 0.5`, true},
+		{`correct_rate < 0.5`, false},
+		{`correct_rate > 7.5e-1`, false},
+		{`trial.id == 12`, true},
+		{`trial.blocks.1 == "b"`, true},
+		{`trial.blocks.2 == "c"`, false},
+		{`"b" < "c"`, true},
+		{`result < 1`, false},
+		{`missing_val == null`, true},
+		{`absent == null`, true},
+		{`done == false`, true},
+		{`result`, true},
+		{`done`, false},
+		{`note`, false},
+		{`absent`, false},
+		{`!absent`, true},
+		{`!!result`, true},
+		{`result == "correct" && correct_rate >= 0.5`, true},
+		{`result == "wrong" || trial.id == 12`, true},
+		{`done || note || absent`, false},
+		{`result == "wrong" && done || trial.id == 12`, true},
+		{`result == "wrong" && (done || trial.id == 12)`, false},
+		{`!(result == "wrong")`, true},
+		{`(trial.id) == 12`, true},
+		{`12 == (trial.id)`, true},
+		{`(result == "correct") == true`, true},
+		{`quote == "it's \"fine\""`, true},
+		{`quote == 'it\'s "fine"'`, true},
+		{`größe == 3`, true},
+		{`"größe" == 'größe'`, true},
+		{strings.Repeat("(", maxFilterDepth) + "result" + strings.Repeat(")", maxFilterDepth), true},
+		{strings.Repeat("!", maxFilterDepth) + "result", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			filter, err := parseFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("parseFilter(%q): %v", tt.filter, err)
+			}
+			if got := truthy(filter.eval(doc)); got != tt.want {
+				t.Errorf("%q = %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []string{
+		``,
+		`result ==`,
+		`== "correct"`,
+		`result == "correct`,
+		`result == 'correct`,
+		`result == "\q"`,
+		`(result == "correct"`,
+		`result == "correct")`,
+		`result "correct"`,
+		`result && `,
+		`!`,
+		`result # 1`,
+		`1.2.3 == 1`,
+		strings.Repeat("(", maxFilterDepth+1) + "result" + strings.Repeat(")", maxFilterDepth+1),
+		strings.Repeat("!", maxFilterDepth+1) + "result",
+		strings.Repeat("(", 100000),
+	}
+
+	for _, filter := range tests {
+		name := filter
+		if len(name) > 40 {
+			name = name[:40]
+		}
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseFilter(filter); err == nil {
+				t.Errorf("parseFilter(%q) succeeded, want error", filter)
+			}
+		})
+	}
+}
+
+func TestDataViewApply(t *testing.T) {
+	packed, err := msgpack.Marshal(map[string]any{"trial": 1, "result": "correct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := parseFilter(`result == "correct"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonMsg := func(data string) message { return message{Seq: 1, Data: []byte(data)} }
+
+	tests := []struct {
+		name            string
+		view            *dataView
+		msg             message
+		wantOK          bool
+		wantData        string
+		wantContentType string
+	}{
+		{
+			name:     "no view",
+			view:     nil,
+			msg:      jsonMsg(`{"result":"correct"}`),
+			wantOK:   true,
+			wantData: `{"result":"correct"}`,
+		},
+		{
+			name:     "filter matches",
+			view:     &dataView{filter: filter},
+			msg:      jsonMsg(`{"result": "correct", "trial": 1}`),
+			wantOK:   true,
+			wantData: `{"result": "correct", "trial": 1}`,
+		},
+		{
+			name:   "filter does not match",
+			view:   &dataView{filter: filter},
+			msg:    jsonMsg(`{"result":"wrong"}`),
+			wantOK: false,
+		},
+		{
+			name:     "fields",
+			view:     &dataView{fields: [][]string{{"trial", "id"}, {"missing"}}},
+			msg:      jsonMsg(`{"result":"correct","trial":{"id":3,"block":1}}`),
+			wantOK:   true,
+			wantData: `{"trial":{"id":3}}`,
+		},
+		{
+			name:     "filter and fields",
+			view:     &dataView{filter: filter, fields: [][]string{{"trial"}}},
+			msg:      jsonMsg(`{"result":"correct","trial":2}`),
+			wantOK:   true,
+			wantData: `{"trial":2}`,
+		},
+		{
+			name:     "fields of a non object",
+			view:     &dataView{fields: [][]string{{"trial"}}},
+			msg:      jsonMsg(`[1,2]`),
+			wantOK:   true,
+			wantData: `[1,2]`,
+		},
+		{
+			name:   "filter on invalid JSON",
+			view:   &dataView{filter: filter},
+			msg:    jsonMsg(`{"result":`),
+			wantOK: false,
+		},
+		{
+			name:   "filter on binary",
+			view:   &dataView{filter: filter},
+			msg:    message{Data: []byte{0xff}, ContentType: contentTypeBinary},
+			wantOK: false,
+		},
+		{
+			name:            "fields pass binary through",
+			view:            &dataView{fields: [][]string{{"trial"}}},
+			msg:             message{Data: []byte{0xff}, ContentType: contentTypeBinary},
+			wantOK:          true,
+			wantData:        "\xff",
+			wantContentType: contentTypeBinary,
+		},
+		{
+			name:     "filter on MessagePack",
+			view:     &dataView{filter: filter, fields: [][]string{{"trial"}}},
+			msg:      message{Data: packed, ContentType: contentTypeMsgPack},
+			wantOK:   true,
+			wantData: `{"trial":1}`,
+		},
+		{
+			name:     "transcode MessagePack",
+			view:     &dataView{transcode: true},
+			msg:      message{Data: packed, ContentType: contentTypeMsgPack},
+			wantOK:   true,
+			wantData: `{"result":"correct","trial":1}`,
+		},
+		{
+			name:     "transcode filtered MessagePack",
+			view:     &dataView{filter: filter, transcode: true},
+			msg:      message{Data: packed, ContentType: contentTypeMsgPack},
+			wantOK:   true,
+			wantData: `{"result":"correct","trial":1}`,
+		},
+		{
+			name:            "MessagePack is kept without transcode",
+			view:            &dataView{},
+			msg:             message{Data: packed, ContentType: contentTypeMsgPack},
+			wantOK:          true,
+			wantData:        string(packed),
+			wantContentType: contentTypeMsgPack,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.view.apply(tt.msg)
+			if ok != tt.wantOK {
+				t.Fatalf("apply ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if string(got.Data) != tt.wantData {
+				t.Errorf("apply data = %s, want %s", got.Data, tt.wantData)
+			}
+			if got.ContentType != tt.wantContentType {
+				t.Errorf("apply content type = %q, want %q", got.ContentType, tt.wantContentType)
+			}
+			if got.Seq != tt.msg.Seq {
+				t.Errorf("apply seq = %d, want %d", got.Seq, tt.msg.Seq)
+			}
+		})
+	}
+}
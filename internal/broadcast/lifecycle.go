@@ -0,0 +1,176 @@
+package broadcast
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/commonTypes"
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// how often endpoints are checked against their idle TTL
+const ttlCheckInterval = 10 * time.Second
+
+// names of expired endpoints whose history is still being deleted, guarded
+// by broadEndpointsMu. They cannot be created again until it is gone.
+var reapingEndpoints = make(map[string]bool)
+
+// EndpointInfo describes a broadcast endpoint and its activity
+type EndpointInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// ID of the experiment that owns the endpoint
+	Owner   string    `json:"owner,omitempty"`
+	Created time.Time `json:"created"`
+	// Time of the latest publish, null if nothing was published
+	LastPublish *time.Time `json:"last_publish"`
+	// Number of messages published since the endpoint was created
+	MessageCount    uint64 `json:"message_count"`
+	SubscriberCount int    `json:"subscriber_count"`
+	// Seconds without publishes and subscribers after which the endpoint is
+	// deleted, zero keeps it forever
+	IdleTTL int64 `json:"idle_ttl,omitempty"`
+	// Time the endpoint will be deleted if it stays idle
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// number of client subscribers, internal ones are left out
+func (e *BroadcastEndpoint) clientCountLocked() int {
+	count := 0
+	for _, sub := range e.subscribers {
+		if !sub.internal() {
+			count++
+		}
+	}
+	return count
+}
+
+// mark the endpoint as in use
+func (e *BroadcastEndpoint) touchLocked(now time.Time) {
+	e.lastActive = now
+}
+
+func (e *BroadcastEndpoint) infoLocked() EndpointInfo {
+	clients := e.clientCountLocked()
+	info := EndpointInfo{
+		Name:            e.name,
+		Description:     e.description,
+		Owner:           e.owner,
+		Created:         e.created,
+		MessageCount:    e.lastSeq,
+		SubscriberCount: clients,
+		IdleTTL:         e.idleTTL,
+	}
+	if !e.lastPublish.IsZero() {
+		lastPublish := e.lastPublish
+		info.LastPublish = &lastPublish
+	}
+	if e.idleTTL > 0 && clients == 0 {
+		expiresAt := e.lastActive.Add(time.Duration(e.idleTTL) * time.Second)
+		info.ExpiresAt = &expiresAt
+	}
+	return info
+}
+
+// whether the endpoint has been unused for longer than its idle TTL
+func (e *BroadcastEndpoint) expiredLocked(now time.Time) bool {
+	if e.idleTTL <= 0 || e.clientCountLocked() > 0 {
+		return false
+	}
+	return now.Sub(e.lastActive) >= time.Duration(e.idleTTL)*time.Second
+}
+
+// periodically delete endpoints that outlived their idle TTL
+func reapIdleEndpoints() {
+	ticker := time.NewTicker(ttlCheckInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		var expired []*BroadcastEndpoint
+
+		broadEndpointsMu.Lock()
+		for name, endpoint := range broadEndpoints {
+			endpoint.mu.Lock()
+			idle := endpoint.expiredLocked(now)
+			endpoint.mu.Unlock()
+			if !idle {
+				continue
+			}
+
+			delete(broadEndpoints, name)
+			reapingEndpoints[name] = true
+			expired = append(expired, endpoint)
+		}
+		broadEndpointsMu.Unlock()
+
+		// closing sockets and files must not hold up the other endpoints
+		for _, endpoint := range expired {
+			if err := endpoint.remove(); err != nil {
+				logger.Logger.Warn(
+					"failed to remove broadcast history: ",
+					slog.Group(
+						logKey,
+						slog.String("endpoint", endpoint.name),
+						slog.String("error", err.Error()),
+					),
+				)
+			}
+
+			broadEndpointsMu.Lock()
+			delete(reapingEndpoints, endpoint.name)
+			broadEndpointsMu.Unlock()
+
+			logger.Logger.Info(
+				"deleted idle broadcast endpoint: ",
+				slog.Group(
+					logKey,
+					slog.String("endpoint", endpoint.name),
+				),
+			)
+		}
+	}
+}
+
+// detailed listing of all broadcast endpoints, sorted by name
+func endpointInfos() []EndpointInfo {
+	broadEndpointsMu.RLock()
+	defer broadEndpointsMu.RUnlock()
+
+	infos := make([]EndpointInfo, 0, len(broadEndpoints))
+	for _, endpoint := range broadEndpoints {
+		endpoint.mu.Lock()
+		infos = append(infos, endpoint.infoLocked())
+		endpoint.mu.Unlock()
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// Get the metadata and activity of the broadcast endpoint
+func GetBroadcastInfo(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	c.JSON(http.StatusOK, endpoint.infoLocked())
+}
@@ -0,0 +1,126 @@
+package broadcast
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	contentTypeJSON    = "application/json"
+	contentTypeMsgPack = "application/msgpack"
+	contentTypeBinary  = "application/octet-stream"
+)
+
+// media type of a published payload from its Content-Type header
+func parseContentType(header string) string {
+	if header == "" {
+		return contentTypeJSON
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return contentTypeBinary
+	}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		// sent by curl -d and most HTTP clients for untyped bodies, the
+		// payloads were always handled as JSON
+		return contentTypeJSON
+	case "application/x-msgpack", "application/vnd.msgpack":
+		return contentTypeMsgPack
+	}
+	return mediaType
+}
+
+func (m message) contentType() string {
+	if m.ContentType == "" {
+		// persisted before content types were kept
+		return contentTypeJSON
+	}
+	return m.ContentType
+}
+
+func (m message) isJSON() bool {
+	contentType := m.contentType()
+	return contentType == contentTypeJSON || strings.HasSuffix(contentType, "+json")
+}
+
+func (m message) isMsgPack() bool {
+	return m.contentType() == contentTypeMsgPack
+}
+
+// whether the payload can be sent as is in text frames
+func (m message) isText() bool {
+	return m.isJSON() || strings.HasPrefix(m.contentType(), "text/")
+}
+
+// JSON form of the payload, MessagePack payloads are transcoded
+func (m message) asJSON() ([]byte, bool) {
+	switch {
+	case m.isJSON():
+		return m.Data, json.Valid(m.Data)
+	case m.isMsgPack():
+		data, err := msgpackToJSON(m.Data)
+		return data, err == nil
+	}
+	return nil, false
+}
+
+// decoded JSON form of the payload
+func (m message) decode() (any, bool) {
+	data, ok := m.asJSON()
+	if !ok {
+		return nil, false
+	}
+
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, false
+	}
+	return doc, true
+}
+
+// transcode a MessagePack payload to JSON
+func msgpackToJSON(data []byte) ([]byte, error) {
+	var value any
+	if err := msgpack.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("invalid msgpack: %w", err)
+	}
+	return json.Marshal(jsonValue(value))
+}
+
+// convert decoded MessagePack maps with non string keys, which JSON cannot
+// represent
+func jsonValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			v[key] = jsonValue(child)
+		}
+		return v
+	case map[any]any:
+		object := make(map[string]any, len(v))
+		for key, child := range v {
+			object[fmt.Sprint(key)] = jsonValue(child)
+		}
+		return object
+	case []any:
+		for i, child := range v {
+			v[i] = jsonValue(child)
+		}
+		return v
+	}
+	return value
+}
+
+// binary payload sent over SSE
+type binaryEvent struct {
+	ContentType string `json:"content_type"`
+	// Payload, base64 encoded
+	Data []byte `json:"data"`
+}
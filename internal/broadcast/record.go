@@ -0,0 +1,474 @@
+package broadcast
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/commonTypes"
+	"github.com/Ccccraz/cogmoteGO/internal/experiments"
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ndjsonSuffix = ".ndjson"
+	csvSuffix    = ".csv"
+)
+
+// Recording writes every message of an endpoint into the data directory of
+// an experiment, so the files are served under /data. Messages are stored as
+// NDJSON lines of {"seq", "received", "data"} and, optionally, as a CSV file
+// with the fields of JSON object payloads flattened into dotted columns.
+// MessagePack payloads are stored as JSON and other binary payloads base64
+// encoded, along with their content_type.
+type Recording struct {
+	// ID of the experiment whose data path receives the files
+	ExperimentID string `json:"experiment_id" binding:"required"`
+	// Base name of the files, defaults to <endpoint>-<start time>
+	Name string `json:"name,omitempty"`
+	// Also write a CSV file
+	CSV bool `json:"csv,omitempty"`
+	// CSV columns after seq and received, defaults to the fields of the
+	// first recorded object
+	Columns []string `json:"columns,omitempty"`
+	// Time the recording was started
+	Started time.Time `json:"started"`
+	// Files the recording writes to
+	Files []string `json:"files"`
+}
+
+// RecordingStatus is a recording as reported by the API
+type RecordingStatus struct {
+	Recording
+	// Number of recorded messages
+	Recorded uint64 `json:"recorded"`
+	// Number of messages that could not be written
+	Failed uint64 `json:"failed"`
+}
+
+// line of an NDJSON recording
+type recordLine struct {
+	Seq         uint64          `json:"seq"`
+	Received    time.Time       `json:"received"`
+	ContentType string          `json:"content_type,omitempty"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// open files of a running recording, protected by the mutex of its endpoint
+type recorder struct {
+	config   Recording
+	ndjson   *os.File
+	csvFile  *os.File
+	csv      *csv.Writer
+	header   bool // whether the CSV header has been written
+	recorded uint64
+	failed   uint64
+}
+
+// open the files of config for appending, a resumed recording continues
+// the existing files
+func openRecorder(config Recording) (*recorder, error) {
+	r := &recorder{config: config}
+
+	var err error
+	r.ndjson, err = os.OpenFile(config.Files[0], os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+
+	if config.CSV {
+		r.csvFile, err = os.OpenFile(config.Files[1], os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			_ = r.ndjson.Close()
+			return nil, fmt.Errorf("failed to open csv recording: %w", err)
+		}
+		info, err := r.csvFile.Stat()
+		if err != nil {
+			_ = r.close()
+			return nil, fmt.Errorf("failed to open csv recording: %w", err)
+		}
+		r.header = info.Size() > 0
+		r.csv = csv.NewWriter(r.csvFile)
+	}
+
+	return r, nil
+}
+
+// write msg to the recording, reporting whether the CSV columns were chosen
+func (r *recorder) write(msg message) (bool, error) {
+	data, ok := msg.asJSON()
+	switch {
+	case ok:
+	case msg.isText():
+		data = jsonPayload(msg.Data)
+	default:
+		data, _ = json.Marshal(msg.Data)
+	}
+
+	line, err := json.Marshal(recordLine{
+		Seq:         msg.Seq,
+		Received:    msg.Time,
+		ContentType: msg.ContentType,
+		Data:        data,
+	})
+	if err != nil {
+		return false, err
+	}
+	if _, err := r.ndjson.Write(append(line, '\n')); err != nil {
+		return false, err
+	}
+
+	if r.csv == nil {
+		return false, nil
+	}
+
+	doc, _ := msg.decode()
+	object, ok := doc.(map[string]any)
+	if !ok {
+		// only JSON objects have columns
+		return false, nil
+	}
+	fields := make(map[string]string)
+	flatten("", object, fields)
+
+	chosen := false
+	if r.config.Columns == nil {
+		for column := range fields {
+			r.config.Columns = append(r.config.Columns, column)
+		}
+		slices.Sort(r.config.Columns)
+		chosen = true
+	}
+
+	if !r.header {
+		header := append([]string{"seq", "received"}, r.config.Columns...)
+		if err := r.csv.Write(header); err != nil {
+			return chosen, err
+		}
+		r.header = true
+	}
+
+	row := make([]string, 0, len(r.config.Columns)+2)
+	row = append(row, strconv.FormatUint(msg.Seq, 10), msg.Time.Format(time.RFC3339Nano))
+	for _, column := range r.config.Columns {
+		row = append(row, fields[column])
+	}
+	if err := r.csv.Write(row); err != nil {
+		return chosen, err
+	}
+	r.csv.Flush()
+
+	return chosen, r.csv.Error()
+}
+
+// flatten nested objects into dotted keys, arrays are kept as JSON
+func flatten(prefix string, value any, fields map[string]string) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flatten(key, child, fields)
+		}
+	case nil:
+		fields[prefix] = ""
+	case string:
+		fields[prefix] = v
+	case float64:
+		fields[prefix] = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		fields[prefix] = strconv.FormatBool(v)
+	default:
+		data, _ := json.Marshal(v)
+		fields[prefix] = string(data)
+	}
+}
+
+func (r *recorder) close() error {
+	var errs []error
+	if r.csv != nil {
+		r.csv.Flush()
+		errs = append(errs, r.csv.Error(), r.csvFile.Close())
+	}
+	errs = append(errs, r.ndjson.Close())
+	return errors.Join(errs...)
+}
+
+func (r *recorder) status() RecordingStatus {
+	return RecordingStatus{
+		Recording: r.config,
+		Recorded:  r.recorded,
+		Failed:    r.failed,
+	}
+}
+
+// write msg to the running recording of the endpoint, if any
+func (e *BroadcastEndpoint) recordLocked(msg message) {
+	if e.recorder == nil {
+		return
+	}
+
+	chosen, err := e.recorder.write(msg)
+	if err != nil {
+		// only log the first failure to avoid flooding the log
+		e.recorder.failed++
+		if e.recorder.failed == 1 {
+			logger.Logger.Error(
+				"failed to record broadcast data: ",
+				slog.Group(
+					logKey,
+					slog.String("endpoint", e.name),
+					slog.String("error", err.Error()),
+				),
+			)
+		}
+	} else {
+		e.recorder.recorded++
+	}
+
+	if chosen {
+		if err := e.saveMetaLocked(); err != nil {
+			logger.Logger.Warn(
+				"failed to save recording columns: ",
+				slog.Group(
+					logKey,
+					slog.String("endpoint", e.name),
+					slog.String("error", err.Error()),
+				),
+			)
+		}
+	}
+}
+
+// persisted config of the running recording, nil if not recording
+func (e *BroadcastEndpoint) recordingLocked() *Recording {
+	if e.recorder == nil {
+		return nil
+	}
+	config := e.recorder.config
+	return &config
+}
+
+// resume the persisted recording of a restored endpoint
+func (e *BroadcastEndpoint) restoreRecorderLocked(config *Recording) {
+	if config == nil {
+		return
+	}
+
+	r, err := openRecorder(*config)
+	if err != nil {
+		logger.Logger.Error(
+			"failed to resume recording: ",
+			slog.Group(
+				logKey,
+				slog.String("endpoint", e.name),
+				slog.String("error", err.Error()),
+			),
+		)
+		return
+	}
+	e.recorder = r
+}
+
+func (e *BroadcastEndpoint) stopRecorderLocked() error {
+	if e.recorder == nil {
+		return nil
+	}
+
+	err := e.recorder.close()
+	e.recorder = nil
+	return err
+}
+
+// Get the running recording of the broadcast endpoint
+func GetRecording(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	if endpoint.recorder == nil {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("endpoint: %s is not recording", name),
+			Detail: "",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, endpoint.recorder.status())
+}
+
+// Start recording the broadcast endpoint into the data path of an experiment
+func StartRecording(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	var config Recording
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid recording config",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	dir, err := experiments.DataDir(config.ExperimentID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid recording config",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	config.Started = time.Now()
+	if config.Name == "" {
+		config.Name = fmt.Sprintf("%s-%s", url.PathEscape(name), config.Started.Format("20060102-150405"))
+	}
+	if filepath.Base(config.Name) != config.Name || config.Name == "." || config.Name == ".." {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid recording config",
+			Detail: fmt.Sprintf("invalid file name: %s", config.Name),
+		})
+		return
+	}
+
+	config.Files = []string{filepath.Join(dir, config.Name+ndjsonSuffix)}
+	if config.CSV {
+		config.Files = append(config.Files, filepath.Join(dir, config.Name+csvSuffix))
+	}
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	if endpoint.recorder != nil {
+		c.JSON(http.StatusConflict, commonTypes.APIError{
+			Error:  fmt.Sprintf("endpoint: %s is already recording", name),
+			Detail: "",
+		})
+		return
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  "failed to create experiment data path",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	r, err := openRecorder(config)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to start recording endpoint: %s", name),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	endpoint.recorder = r
+	if err := endpoint.saveMetaLocked(); err != nil {
+		logger.Logger.Warn(
+			"failed to persist recording, it will not resume after a restart: ",
+			slog.Group(
+				logKey,
+				slog.String("endpoint", name),
+				slog.String("error", err.Error()),
+			),
+		)
+	}
+
+	logger.Logger.Info(
+		"recording started: ",
+		slog.Group(
+			logKey,
+			slog.String("endpoint", name),
+			slog.Any("files", config.Files),
+		),
+	)
+
+	c.JSON(http.StatusCreated, r.status())
+}
+
+// Stop recording the broadcast endpoint
+func StopRecording(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	if endpoint.recorder == nil {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("endpoint: %s is not recording", name),
+			Detail: "",
+		})
+		return
+	}
+
+	status := endpoint.recorder.status()
+	if err := endpoint.stopRecorderLocked(); err != nil {
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to close recording of endpoint: %s", name),
+			Detail: err.Error(),
+		})
+		return
+	}
+	if err := endpoint.saveMetaLocked(); err != nil {
+		logger.Logger.Warn(
+			"failed to persist stopped recording: ",
+			slog.Group(
+				logKey,
+				slog.String("endpoint", name),
+				slog.String("error", err.Error()),
+			),
+		)
+	}
+
+	c.JSON(http.StatusOK, status)
+}
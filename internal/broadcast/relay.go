@@ -0,0 +1,624 @@
+package broadcast
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/commonTypes"
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	relaysFile = "relays.json"
+
+	// delay before the first reconnection, doubled up to relayMaxBackoff
+	relayMinBackoff = time.Second
+	relayMaxBackoff = 30 * time.Second
+	// minimum time between two saves of the relay cursors
+	relaySaveInterval = time.Second
+)
+
+var (
+	relays   = make(map[string]*relay) // running relays by name
+	relaysMu sync.Mutex                // mutex to protect relays
+)
+
+// Relay subscribes to broadcast endpoints of a remote cogmoteGO instance and
+// republishes them locally as <name>.<endpoint>, e.g. rig3.default. Dropped
+// connections are retried and resume after the last relayed message.
+type Relay struct {
+	// Namespace of the relayed endpoints
+	Name string `json:"name" binding:"required"`
+	// API base URL of the remote instance, e.g. http://rig3:9012/api
+	URL string `json:"url" binding:"required"`
+	// Remote endpoints to relay, defaults to default
+	Endpoints []string `json:"endpoints,omitempty"`
+	// Sequence number of the last relayed message per remote endpoint
+	Cursors map[string]uint64 `json:"cursors,omitempty"`
+}
+
+// separates the relay name from the remote endpoint name in the name of a
+// relayed endpoint
+const relaySeparator = "."
+
+// local name of the remote endpoint relayed by the relay name
+func relayedName(name string, remote string) string {
+	return name + relaySeparator + remote
+}
+
+func (r *Relay) validate() error {
+	if err := validateEndpointName(r.Name); err != nil {
+		return err
+	}
+	if strings.Contains(r.Name, relaySeparator) {
+		return fmt.Errorf("name must not contain %s", relaySeparator)
+	}
+
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported url scheme: %s", u.Scheme)
+	}
+	r.URL = strings.TrimSuffix(r.URL, "/")
+
+	if len(r.Endpoints) == 0 {
+		r.Endpoints = []string{"default"}
+	}
+	for _, endpoint := range r.Endpoints {
+		if err := validateEndpointName(endpoint); err != nil {
+			return fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+		}
+	}
+	return nil
+}
+
+// RelayEndpointStatus reports the connection to a remote endpoint
+type RelayEndpointStatus struct {
+	Remote    string     `json:"remote"`
+	Local     string     `json:"local"`
+	Connected bool       `json:"connected"`
+	LastSeq   uint64     `json:"last_seq"`
+	Relayed   uint64     `json:"relayed"`
+	Retries   uint64     `json:"retries"`
+	LastError string     `json:"last_error,omitempty"`
+	LastEvent *time.Time `json:"last_event,omitempty"`
+}
+
+// running relay
+type relay struct {
+	mu       sync.Mutex // mutex to protect config and status
+	config   Relay
+	status   map[string]*RelayEndpointStatus
+	lastSave time.Time
+	pending  bool // whether a delayed save is scheduled
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func startRelay(config Relay) *relay {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r := &relay{
+		config: config,
+		status: make(map[string]*RelayEndpointStatus),
+		cancel: cancel,
+	}
+	if r.config.Cursors == nil {
+		r.config.Cursors = make(map[string]uint64)
+	}
+
+	for _, remote := range config.Endpoints {
+		r.status[remote] = &RelayEndpointStatus{
+			Remote:  remote,
+			Local:   relayedName(config.Name, remote),
+			LastSeq: r.config.Cursors[remote],
+		}
+
+		r.wg.Add(1)
+		go r.run(ctx, remote)
+	}
+
+	logger.Logger.Info(
+		"broadcast relay started: ",
+		slog.Group(
+			logKey,
+			slog.String("relay", config.Name),
+			slog.String("url", config.URL),
+			slog.Any("endpoints", config.Endpoints),
+		),
+	)
+
+	return r
+}
+
+func (r *relay) stop() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// relay a remote endpoint until the relay is stopped
+func (r *relay) run(ctx context.Context, remote string) {
+	defer r.wg.Done()
+
+	backoff := relayMinBackoff
+	for {
+		err := r.stream(ctx, remote, func() { backoff = relayMinBackoff })
+
+		r.mu.Lock()
+		status := r.status[remote]
+		status.Connected = false
+		if ctx.Err() == nil {
+			status.Retries++
+			if err != nil {
+				status.LastError = err.Error()
+			}
+		}
+		r.mu.Unlock()
+
+		if ctx.Err() != nil {
+			r.saveCursors(true)
+			return
+		}
+
+		logger.Logger.Warn(
+			"broadcast relay disconnected, reconnecting: ",
+			slog.Group(
+				logKey,
+				slog.String("relay", r.config.Name),
+				slog.String("endpoint", remote),
+				slog.Duration("backoff", backoff),
+				slog.Any("error", err),
+			),
+		)
+
+		select {
+		case <-ctx.Done():
+			r.saveCursors(true)
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, relayMaxBackoff)
+	}
+}
+
+// subscribe to the remote endpoint via SSE and publish every event locally
+func (r *relay) stream(ctx context.Context, remote string, connected func()) error {
+	r.mu.Lock()
+	target := r.config.URL + "/broadcast/data/" + url.PathEscape(remote)
+	cursor := r.config.Cursors[remote]
+	local := r.status[remote].Local
+	r.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if cursor > 0 {
+		// resume after the last relayed message
+		req.Header.Set("Last-Event-ID", strconv.FormatUint(cursor, 10))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	connected()
+	r.mu.Lock()
+	r.status[remote].Connected = true
+	r.status[remote].LastError = ""
+	r.mu.Unlock()
+
+	return readSSE(resp.Body, func(id string, event string, data []byte) {
+		seq, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return
+		}
+
+		contentType := contentTypeJSON
+		switch event {
+		case "message":
+		case "binary":
+			var binary binaryEvent
+			if err := json.Unmarshal(data, &binary); err != nil {
+				return
+			}
+			contentType, data = binary.ContentType, binary.Data
+		default:
+			return
+		}
+
+		endpoint := relayEndpoint(local, r.config.URL, remote)
+		if _, err := endpoint.publish(data, contentType); err != nil {
+			logger.Logger.Warn(
+				"broadcast relay dropped rejected message: ",
+				slog.Group(
+					logKey,
+					slog.String("endpoint", local),
+					slog.String("error", err.Error()),
+				),
+			)
+		}
+
+		now := time.Now()
+		r.mu.Lock()
+		r.config.Cursors[remote] = seq
+		status := r.status[remote]
+		status.LastSeq = seq
+		status.Relayed++
+		status.LastEvent = &now
+		r.mu.Unlock()
+
+		r.saveCursors(false)
+	})
+}
+
+// read Server-Sent Events from body until it ends
+func readSSE(body io.Reader, handle func(id string, event string, data []byte)) error {
+	reader := bufio.NewReader(body)
+
+	var id, event string
+	var data []byte
+	hasData := false
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return errors.New("stream closed by remote")
+			}
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			// blank line dispatches the event
+			if hasData {
+				if event == "" {
+					event = "message"
+				}
+				handle(id, event, data)
+			}
+			id, event, data, hasData = "", "", nil, false
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			id = value
+		case "event":
+			event = value
+		case "data":
+			if hasData {
+				data = append(data, '\n')
+			}
+			data = append(data, value...)
+			hasData = true
+		}
+	}
+}
+
+// local endpoint of a relayed remote endpoint, created if it does not exist
+func relayEndpoint(name string, remoteURL string, remote string) *BroadcastEndpoint {
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+	if exists {
+		return endpoint
+	}
+
+	broadEndpointsMu.Lock()
+	defer broadEndpointsMu.Unlock()
+
+	if endpoint, exists := broadEndpoints[name]; exists {
+		return endpoint
+	}
+
+	meta := endpointMeta{
+		Name:        name,
+		Description: fmt.Sprintf("relay of %s/broadcast/data/%s", remoteURL, remote),
+	}
+	endpoint, err := newEndpoint(meta)
+	if err != nil {
+		logger.Logger.Error(
+			"failed to persist relayed endpoint, keeping it in memory only: ",
+			slog.Group(
+				logKey,
+				slog.String("endpoint", name),
+				slog.String("error", err.Error()),
+			),
+		)
+		endpoint = &BroadcastEndpoint{
+			name:        name,
+			description: meta.Description,
+			created:     time.Now(),
+			lastActive:  time.Now(),
+			subscribers: make([]*subscriber, 0),
+		}
+	}
+	broadEndpoints[name] = endpoint
+
+	return endpoint
+}
+
+func (r *relay) statusLocked() []RelayEndpointStatus {
+	statuses := make([]RelayEndpointStatus, 0, len(r.status))
+	for _, remote := range r.config.Endpoints {
+		statuses = append(statuses, *r.status[remote])
+	}
+	return statuses
+}
+
+// persist the cursors, at most once per relaySaveInterval unless forced.
+// Skipped saves are made up for once the interval has passed, so at most the
+// messages of the last interval are relayed again after a crash.
+func (r *relay) saveCursors(force bool) {
+	r.mu.Lock()
+	if wait := relaySaveInterval - time.Since(r.lastSave); !force && wait > 0 {
+		if !r.pending {
+			r.pending = true
+			time.AfterFunc(wait, func() { r.saveCursors(true) })
+		}
+		r.mu.Unlock()
+		return
+	}
+	r.lastSave = time.Now()
+	r.pending = false
+	r.mu.Unlock()
+
+	relaysMu.Lock()
+	defer relaysMu.Unlock()
+
+	if relays[r.config.Name] != r {
+		// relay was deleted
+		return
+	}
+	if err := saveRelaysLocked(); err != nil {
+		logger.Logger.Warn(
+			"failed to save broadcast relays: ",
+			slog.Group(
+				logKey,
+				slog.String("error", err.Error()),
+			),
+		)
+	}
+}
+
+func saveRelaysLocked() error {
+	configs := make([]Relay, 0, len(relays))
+	for _, r := range relays {
+		r.mu.Lock()
+		config := r.config
+		config.Cursors = make(map[string]uint64, len(r.config.Cursors))
+		for remote, seq := range r.config.Cursors {
+			config.Cursors[remote] = seq
+		}
+		r.mu.Unlock()
+
+		configs = append(configs, config)
+	}
+	sort.Slice(configs, func(i, j int) bool {
+		return configs[i].Name < configs[j].Name
+	})
+
+	data, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal relays: %w", err)
+	}
+
+	if err := os.MkdirAll(storeDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create broadcast store: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(storeDir, relaysFile), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write relays: %w", err)
+	}
+	return nil
+}
+
+// start the relays persisted under the broadcast store
+func loadRelays() {
+	data, err := os.ReadFile(filepath.Join(storeDir, relaysFile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Logger.Error(
+				"failed to read broadcast relays: ",
+				slog.Group(
+					logKey,
+					slog.String("error", err.Error()),
+				),
+			)
+		}
+		return
+	}
+
+	var configs []Relay
+	if err := json.Unmarshal(data, &configs); err != nil {
+		logger.Logger.Error(
+			"invalid broadcast relays file: ",
+			slog.Group(
+				logKey,
+				slog.String("error", err.Error()),
+			),
+		)
+		return
+	}
+
+	relaysMu.Lock()
+	defer relaysMu.Unlock()
+
+	for _, config := range configs {
+		if err := config.validate(); err != nil {
+			logger.Logger.Error(
+				"invalid broadcast relay: ",
+				slog.Group(
+					logKey,
+					slog.String("relay", config.Name),
+					slog.String("error", err.Error()),
+				),
+			)
+			continue
+		}
+		relays[config.Name] = startRelay(config)
+	}
+}
+
+// List all relays with the state of their connections
+func GetRelays(c *gin.Context) {
+	relaysMu.Lock()
+	defer relaysMu.Unlock()
+
+	result := make([]gin.H, 0, len(relays))
+	for _, r := range relays {
+		r.mu.Lock()
+		result = append(result, gin.H{
+			"name":      r.config.Name,
+			"url":       r.config.URL,
+			"endpoints": r.statusLocked(),
+		})
+		r.mu.Unlock()
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i]["name"].(string) < result[j]["name"].(string)
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"relays": result,
+	})
+}
+
+// Get a relay with the state of its connections
+func GetRelay(c *gin.Context) {
+	name := c.Param("relay")
+
+	relaysMu.Lock()
+	r, exists := relays[name]
+	relaysMu.Unlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("relay: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"name":      r.config.Name,
+		"url":       r.config.URL,
+		"endpoints": r.statusLocked(),
+	})
+}
+
+// Start relaying endpoints of a remote cogmoteGO instance
+func CreateRelay(c *gin.Context) {
+	var config Relay
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid relay config",
+			Detail: err.Error(),
+		})
+		return
+	}
+	if err := config.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid relay config",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	relaysMu.Lock()
+	if _, exists := relays[config.Name]; exists {
+		relaysMu.Unlock()
+		c.JSON(http.StatusConflict, commonTypes.APIError{
+			Error:  fmt.Sprintf("relay: %s already exists", config.Name),
+			Detail: "",
+		})
+		return
+	}
+
+	r := startRelay(config)
+	relays[config.Name] = r
+
+	err := saveRelaysLocked()
+	if err != nil {
+		delete(relays, config.Name)
+	}
+	relaysMu.Unlock()
+
+	if err != nil {
+		r.stop()
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to save relay: %s", config.Name),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c.JSON(http.StatusCreated, r.config)
+}
+
+// Stop a relay, the relayed endpoints and their history are kept
+func DeleteRelay(c *gin.Context) {
+	name := c.Param("relay")
+
+	relaysMu.Lock()
+	r, exists := relays[name]
+	if !exists {
+		relaysMu.Unlock()
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("relay: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+	delete(relays, name)
+	err := saveRelaysLocked()
+	relaysMu.Unlock()
+
+	// stop outside of relaysMu, the relay saves its cursors when stopping
+	r.stop()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to save relays after deleting: %s", name),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,75 @@
+package broadcast
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// which part of the history a new subscriber wants replayed
+type replayOptions struct {
+	// only replay messages with a sequence number above since
+	since    uint64
+	hasSince bool
+	// only replay the last tail messages, zero means no limit
+	tail int
+}
+
+// parse the Last-Event-ID header and the since/tail query parameters,
+// an explicit since takes precedence over Last-Event-ID
+func parseReplayOptions(c *gin.Context) (replayOptions, error) {
+	var opts replayOptions
+
+	if lastEventID := c.GetHeader("Last-Event-ID"); lastEventID != "" {
+		since, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid Last-Event-ID: %s", lastEventID)
+		}
+		opts.since = since
+		opts.hasSince = true
+	}
+
+	if raw, ok := c.GetQuery("since"); ok {
+		since, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid since: %s", raw)
+		}
+		opts.since = since
+		opts.hasSince = true
+	}
+
+	if raw, ok := c.GetQuery("tail"); ok {
+		tail, err := strconv.Atoi(raw)
+		if err != nil || tail < 0 {
+			return opts, fmt.Errorf("invalid tail: %s", raw)
+		}
+		opts.tail = tail
+		if tail == 0 {
+			// tail=0 asks for live data only
+			opts.tail = -1
+		}
+	}
+
+	return opts, nil
+}
+
+// select the messages of history matching opts
+func (opts replayOptions) apply(history []message) []message {
+	if opts.hasSince {
+		start := sort.Search(len(history), func(i int) bool {
+			return history[i].Seq > opts.since
+		})
+		history = history[start:]
+	}
+
+	switch {
+	case opts.tail < 0:
+		history = nil
+	case opts.tail > 0 && len(history) > opts.tail:
+		history = history[len(history)-opts.tail:]
+	}
+
+	return history
+}
@@ -0,0 +1,90 @@
+package broadcast
+
+import (
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseReplayOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		lastEventID string
+		want        replayOptions
+		wantErr     bool
+	}{
+		{name: "nothing", want: replayOptions{}},
+		{name: "last event id", lastEventID: "5", want: replayOptions{since: 5, hasSince: true}},
+		{name: "since", query: "since=7", want: replayOptions{since: 7, hasSince: true}},
+		{name: "since zero", query: "since=0", want: replayOptions{since: 0, hasSince: true}},
+		{name: "since wins over last event id", query: "since=7", lastEventID: "5", want: replayOptions{since: 7, hasSince: true}},
+		{name: "tail", query: "tail=3", want: replayOptions{tail: 3}},
+		{name: "tail zero is live only", query: "tail=0", want: replayOptions{tail: -1}},
+		{name: "since and tail", query: "since=2&tail=3", want: replayOptions{since: 2, hasSince: true, tail: 3}},
+		{name: "invalid last event id", lastEventID: "abc", wantErr: true},
+		{name: "invalid since", query: "since=x", wantErr: true},
+		{name: "negative since", query: "since=-1", wantErr: true},
+		{name: "invalid tail", query: "tail=x", wantErr: true},
+		{name: "negative tail", query: "tail=-1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/?"+tt.query, nil)
+			if tt.lastEventID != "" {
+				c.Request.Header.Set("Last-Event-ID", tt.lastEventID)
+			}
+
+			got, err := parseReplayOptions(c)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseReplayOptions = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseReplayOptions: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("parseReplayOptions = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayOptionsApply(t *testing.T) {
+	var history []message
+	for _, seq := range []uint64{1, 2, 3, 6, 7} {
+		history = append(history, message{Seq: seq})
+	}
+
+	tests := []struct {
+		name string
+		opts replayOptions
+		want []uint64
+	}{
+		{"everything", replayOptions{}, []uint64{1, 2, 3, 6, 7}},
+		{"since", replayOptions{since: 2, hasSince: true}, []uint64{3, 6, 7}},
+		{"since zero", replayOptions{since: 0, hasSince: true}, []uint64{1, 2, 3, 6, 7}},
+		{"since a missing sequence number", replayOptions{since: 4, hasSince: true}, []uint64{6, 7}},
+		{"since the latest", replayOptions{since: 7, hasSince: true}, []uint64{}},
+		{"since expired history", replayOptions{since: 100, hasSince: true}, []uint64{}},
+		{"tail", replayOptions{tail: 2}, []uint64{6, 7}},
+		{"tail longer than history", replayOptions{tail: 10}, []uint64{1, 2, 3, 6, 7}},
+		{"live only", replayOptions{tail: -1}, []uint64{}},
+		{"since and tail", replayOptions{since: 1, hasSince: true, tail: 2}, []uint64{6, 7}},
+		{"live only ignores since", replayOptions{since: 1, hasSince: true, tail: -1}, []uint64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := seqsOf(tt.opts.apply(history)); !slices.Equal(got, tt.want) {
+				t.Errorf("apply = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
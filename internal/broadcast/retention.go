@@ -0,0 +1,52 @@
+package broadcast
+
+import (
+	"time"
+)
+
+// Retention bounds the history kept by a broadcast endpoint. Zero fields fall
+// back to the defaults from the broadcast section of the config file, where
+// zero means unlimited.
+type Retention struct {
+	// Maximum number of messages kept
+	MaxCount int `json:"max_count,omitempty"`
+	// Maximum total payload size in bytes
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	// Maximum message age in seconds
+	MaxAge int64 `json:"max_age,omitempty"`
+}
+
+func (r Retention) withDefaults() Retention {
+	if r.MaxCount <= 0 {
+		r.MaxCount = cfg.Broadcast.MaxCount
+	}
+	if r.MaxBytes <= 0 {
+		r.MaxBytes = cfg.Broadcast.MaxBytes
+	}
+	if r.MaxAge <= 0 {
+		r.MaxAge = cfg.Broadcast.MaxAge
+	}
+	return r
+}
+
+// number of leading messages in history that fall outside the policy
+func (r Retention) expired(history []message, size int64, now time.Time) int {
+	maxAge := time.Duration(r.MaxAge) * time.Second
+
+	n := 0
+	for n < len(history) {
+		msg := history[n]
+
+		overCount := r.MaxCount > 0 && len(history)-n > r.MaxCount
+		overBytes := r.MaxBytes > 0 && size > r.MaxBytes
+		overAge := maxAge > 0 && now.Sub(msg.Time) > maxAge
+
+		if !overCount && !overBytes && !overAge {
+			break
+		}
+
+		size -= int64(len(msg.Data))
+		n++
+	}
+	return n
+}
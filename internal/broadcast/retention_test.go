@@ -0,0 +1,67 @@
+package broadcast
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionExpired(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	history := []message{
+		{Seq: 1, Time: now.Add(-180 * time.Second), Data: []byte("aaa")},
+		{Seq: 2, Time: now.Add(-120 * time.Second), Data: []byte("bbb")},
+		{Seq: 3, Time: now.Add(-30 * time.Second), Data: []byte("ccc")},
+		{Seq: 4, Time: now.Add(-10 * time.Second), Data: []byte("ddd")},
+	}
+	size := int64(12)
+
+	tests := []struct {
+		name      string
+		retention Retention
+		want      int
+	}{
+		{"unlimited", Retention{}, 0},
+		{"count", Retention{MaxCount: 3}, 1},
+		{"count not reached", Retention{MaxCount: 4}, 0},
+		{"bytes", Retention{MaxBytes: 7}, 2},
+		{"bytes exactly reached", Retention{MaxBytes: 12}, 0},
+		{"age", Retention{MaxAge: 60}, 2},
+		{"everything too old", Retention{MaxAge: 5}, 4},
+		{"tightest limit wins", Retention{MaxCount: 3, MaxBytes: 100, MaxAge: 150}, 1},
+		{"all limits", Retention{MaxCount: 3, MaxBytes: 4, MaxAge: 150}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.retention.expired(history, size, now); got != tt.want {
+				t.Errorf("expired = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetentionWithDefaults(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.Broadcast.MaxCount = 100
+	cfg.Broadcast.MaxBytes = 1000
+	cfg.Broadcast.MaxAge = 60
+
+	tests := []struct {
+		name      string
+		retention Retention
+		want      Retention
+	}{
+		{"defaults", Retention{}, Retention{MaxCount: 100, MaxBytes: 1000, MaxAge: 60}},
+		{"overrides", Retention{MaxCount: 5, MaxAge: 10}, Retention{MaxCount: 5, MaxBytes: 1000, MaxAge: 10}},
+		{"negative falls back", Retention{MaxCount: -1}, Retention{MaxCount: 100, MaxBytes: 1000, MaxAge: 60}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.retention.withDefaults(); got != tt.want {
+				t.Errorf("withDefaults = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
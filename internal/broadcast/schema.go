@@ -0,0 +1,464 @@
+package broadcast
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/Ccccraz/cogmoteGO/internal/commonTypes"
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	"github.com/gin-gonic/gin"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+const (
+	schemasFile = "schemas.json"
+	// location of a schema in the compiler, keeps paths out of error messages
+	schemaURL = "urn:cogmote:schema"
+)
+
+var (
+	namedSchemas   = make(map[string]*namedSchema) // schemas shared between endpoints
+	namedSchemasMu sync.RWMutex                    // mutex to protect named schemas
+)
+
+type namedSchema struct {
+	raw      json.RawMessage
+	compiled *jsonschema.Schema
+}
+
+// data rejected by the schema of an endpoint
+type schemaError struct {
+	reason string
+	detail string
+}
+
+func (e *schemaError) Error() string {
+	return fmt.Sprintf("%s: %s", e.reason, e.detail)
+}
+
+// ErrSchemaViolation matches the errors of data rejected by the schema of
+// an endpoint
+var ErrSchemaViolation = errors.New("data does not match schema")
+
+func (e *schemaError) Is(target error) bool {
+	return target == ErrSchemaViolation
+}
+
+// SchemaConfig selects the JSON Schema published data must match, either
+// inline or by the name of a schema registered under /broadcast/schemas
+type SchemaConfig struct {
+	Schema    json.RawMessage `json:"schema,omitempty"`
+	SchemaRef string          `json:"schema_ref,omitempty"`
+}
+
+func (s SchemaConfig) isEmpty() bool {
+	return len(s.Schema) == 0 && s.SchemaRef == ""
+}
+
+// check the config and compile its inline schema, if any
+func (s SchemaConfig) compile() (*jsonschema.Schema, error) {
+	if len(s.Schema) > 0 && s.SchemaRef != "" {
+		return nil, errors.New("schema and schema_ref are mutually exclusive")
+	}
+
+	if s.SchemaRef != "" {
+		namedSchemasMu.RLock()
+		_, exists := namedSchemas[s.SchemaRef]
+		namedSchemasMu.RUnlock()
+		if !exists {
+			return nil, fmt.Errorf("schema %s does not exist", s.SchemaRef)
+		}
+		return nil, nil
+	}
+
+	if len(s.Schema) == 0 {
+		return nil, nil
+	}
+	return compileSchema(s.Schema)
+}
+
+func compileSchema(raw json.RawMessage) (*jsonschema.Schema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+
+	compiler := jsonschema.NewCompiler()
+	// only resolve references inside the schema itself
+	compiler.UseLoader(jsonschema.SchemeURLLoader{})
+
+	if err := compiler.AddResource(schemaURL, doc); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	schema, err := compiler.Compile(schemaURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	return schema, nil
+}
+
+// check data against the schema of the endpoint, MessagePack payloads are
+// checked in their JSON form
+func (e *BroadcastEndpoint) validate(data []byte, contentType string) error {
+	e.mu.Lock()
+	schema := e.validator
+	schemaRef := e.schema.SchemaRef
+	e.mu.Unlock()
+
+	if schemaRef != "" {
+		namedSchemasMu.RLock()
+		named, exists := namedSchemas[schemaRef]
+		namedSchemasMu.RUnlock()
+		if !exists {
+			return &schemaError{
+				reason: "schema of endpoint not found",
+				detail: fmt.Sprintf("schema %s does not exist", schemaRef),
+			}
+		}
+		schema = named.compiled
+	}
+
+	if schema == nil {
+		return nil
+	}
+
+	msg := message{Data: data, ContentType: contentType}
+	switch {
+	case msg.isMsgPack():
+		transcoded, err := msgpackToJSON(data)
+		if err != nil {
+			return &schemaError{
+				reason: "data is not valid MessagePack",
+				detail: err.Error(),
+			}
+		}
+		data = transcoded
+	case !msg.isJSON():
+		return &schemaError{
+			reason: "data is not valid JSON",
+			detail: fmt.Sprintf("content type %s can not be checked against a schema", contentType),
+		}
+	}
+
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return &schemaError{
+			reason: "data is not valid JSON",
+			detail: err.Error(),
+		}
+	}
+
+	if err := schema.Validate(instance); err != nil {
+		return &schemaError{
+			reason: "data does not match schema",
+			detail: err.Error(),
+		}
+	}
+	return nil
+}
+
+// replace the schema of the endpoint, an empty config removes it
+func (e *BroadcastEndpoint) setSchema(config SchemaConfig) error {
+	compiled, err := config.compile()
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	previous, previousValidator := e.schema, e.validator
+	e.schema = config
+	e.validator = compiled
+	if err := e.saveMetaLocked(); err != nil {
+		e.schema, e.validator = previous, previousValidator
+		return err
+	}
+	return nil
+}
+
+// load the named schemas persisted under the broadcast store
+func loadSchemas() {
+	data, err := os.ReadFile(filepath.Join(storeDir, schemasFile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Logger.Error(
+				"failed to read broadcast schemas: ",
+				slog.Group(
+					logKey,
+					slog.String("error", err.Error()),
+				),
+			)
+		}
+		return
+	}
+
+	var raws map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raws); err != nil {
+		logger.Logger.Error(
+			"invalid broadcast schemas file: ",
+			slog.Group(
+				logKey,
+				slog.String("error", err.Error()),
+			),
+		)
+		return
+	}
+
+	namedSchemasMu.Lock()
+	defer namedSchemasMu.Unlock()
+
+	for name, raw := range raws {
+		compiled, err := compileSchema(raw)
+		if err != nil {
+			logger.Logger.Error(
+				"failed to restore broadcast schema: ",
+				slog.Group(
+					logKey,
+					slog.String("schema", name),
+					slog.String("error", err.Error()),
+				),
+			)
+			continue
+		}
+		namedSchemas[name] = &namedSchema{raw: raw, compiled: compiled}
+	}
+}
+
+func saveSchemasLocked() error {
+	raws := make(map[string]json.RawMessage, len(namedSchemas))
+	for name, schema := range namedSchemas {
+		raws[name] = schema.raw
+	}
+
+	data, err := json.MarshalIndent(raws, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal schemas: %w", err)
+	}
+
+	if err := os.MkdirAll(storeDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create broadcast store: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(storeDir, schemasFile), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write schemas: %w", err)
+	}
+	return nil
+}
+
+// List all named schemas
+func GetSchemas(c *gin.Context) {
+	namedSchemasMu.RLock()
+	defer namedSchemasMu.RUnlock()
+
+	names := make([]string, 0, len(namedSchemas))
+	for name := range namedSchemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	c.JSON(http.StatusOK, gin.H{
+		"schemas": names,
+	})
+}
+
+// Get a named schema
+func GetSchema(c *gin.Context) {
+	name := c.Param("name")
+
+	namedSchemasMu.RLock()
+	schema, exists := namedSchemas[name]
+	namedSchemasMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("schema: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	c.Data(http.StatusOK, "application/json", schema.raw)
+}
+
+// Create or replace a named schema
+func PutSchema(c *gin.Context) {
+	name := c.Param("name")
+
+	raw, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid schema",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	compiled, err := compileSchema(raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid schema",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	namedSchemasMu.Lock()
+	defer namedSchemasMu.Unlock()
+
+	previous, existed := namedSchemas[name]
+	namedSchemas[name] = &namedSchema{raw: raw, compiled: compiled}
+
+	if err := saveSchemasLocked(); err != nil {
+		if existed {
+			namedSchemas[name] = previous
+		} else {
+			delete(namedSchemas, name)
+		}
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to save schema: %s", name),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	if existed {
+		c.Status(http.StatusOK)
+	} else {
+		c.Status(http.StatusCreated)
+	}
+}
+
+// Delete a named schema that no endpoint refers to
+func DeleteSchema(c *gin.Context) {
+	name := c.Param("name")
+
+	namedSchemasMu.Lock()
+	defer namedSchemasMu.Unlock()
+
+	schema, exists := namedSchemas[name]
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("schema: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	broadEndpointsMu.RLock()
+	var users []string
+	for endpointName, endpoint := range broadEndpoints {
+		endpoint.mu.Lock()
+		if endpoint.schema.SchemaRef == name {
+			users = append(users, endpointName)
+		}
+		endpoint.mu.Unlock()
+	}
+	broadEndpointsMu.RUnlock()
+
+	if len(users) > 0 {
+		sort.Strings(users)
+		c.JSON(http.StatusConflict, commonTypes.APIError{
+			Error:  fmt.Sprintf("schema: %s is still in use", name),
+			Detail: fmt.Sprintf("referenced by endpoints: %v", users),
+		})
+		return
+	}
+
+	delete(namedSchemas, name)
+	if err := saveSchemasLocked(); err != nil {
+		namedSchemas[name] = schema
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to save schemas after deleting: %s", name),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// Set the schema of the broadcast endpoint
+func SetBroadcastSchema(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	var config SchemaConfig
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid schema config",
+			Detail: err.Error(),
+		})
+		return
+	}
+	if config.isEmpty() {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid schema config",
+			Detail: "one of schema or schema_ref is required",
+		})
+		return
+	}
+
+	if _, err := config.compile(); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid schema config",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	if err := endpoint.setSchema(config); err != nil {
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to set schema of endpoint: %s", name),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// Remove the schema of the broadcast endpoint
+func DeleteBroadcastSchema(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	if err := endpoint.setSchema(SchemaConfig{}); err != nil {
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to remove schema of endpoint: %s", name),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,336 @@
+package broadcast
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+)
+
+const (
+	endpointFile  = "endpoint.json"
+	segmentSuffix = ".log"
+)
+
+var (
+	// root directory of all persisted broadcast endpoints
+	storeDir string
+)
+
+// persisted description of a broadcast endpoint
+type endpointMeta struct {
+	Name         string        `json:"name"`
+	Description  string        `json:"description,omitempty"`
+	Owner        string        `json:"owner,omitempty"`
+	Created      time.Time     `json:"created"`
+	IdleTTL      int64         `json:"idle_ttl,omitempty"`
+	Retention    Retention     `json:"retention"`
+	Backpressure Backpressure  `json:"backpressure"`
+	Schema       SchemaConfig  `json:"schema"`
+	Aggregations []Aggregation `json:"aggregations,omitempty"`
+	Alerts       []AlertRule   `json:"alerts,omitempty"`
+	Recording    *Recording    `json:"recording,omitempty"`
+	ZMQ          *ZMQBridge    `json:"zmq,omitempty"`
+}
+
+// segmentLog is an append-only on-disk log of the messages retained by an
+// endpoint. Messages are written as JSON lines into segment files named after
+// the sequence number they start at, so expired messages can be released one
+// whole segment at a time and sequence numbers survive an empty log.
+type segmentLog struct {
+	dir          string
+	segmentBytes int64
+	segments     []*segment
+	active       *os.File
+
+	// sequence number expected for the next appended message
+	next uint64
+
+	// number of leading messages in segments[0] that are no longer retained
+	dropped int
+}
+
+type segment struct {
+	id    uint64
+	size  int64
+	count int
+}
+
+func endpointDir(name string) string {
+	return filepath.Join(storeDir, url.PathEscape(name))
+}
+
+// check name can be stored as a directory of storeDir
+func validateEndpointName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("name must not be empty")
+	case name == "." || name == "..":
+		return fmt.Errorf("name must not be %s", name)
+	case strings.ContainsAny(name, `/\`):
+		return errors.New(`name must not contain / or \`)
+	}
+	return nil
+}
+
+// whether dir is an endpoint dir strictly inside storeDir
+func insideStore(dir string) bool {
+	if storeDir == "" {
+		return false
+	}
+	base := filepath.Base(dir)
+	return filepath.Dir(filepath.Clean(dir)) == filepath.Clean(storeDir) && base != "." && base != ".."
+}
+
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+func saveEndpointMeta(dir string, meta endpointMeta) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create endpoint dir: %w", err)
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal endpoint meta: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, endpointFile), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write endpoint meta: %w", err)
+	}
+	return nil
+}
+
+func loadEndpointMeta(dir string) (endpointMeta, error) {
+	var meta endpointMeta
+
+	data, err := os.ReadFile(filepath.Join(dir, endpointFile))
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("invalid endpoint meta: %w", err)
+	}
+	return meta, nil
+}
+
+// openSegmentLog opens the log stored in dir, creating it if needed, and
+// returns every message found in it from oldest to newest.
+func openSegmentLog(dir string, segmentBytes int64) (*segmentLog, []message, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, fmt.Errorf("failed to create log dir: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read log dir: %w", err)
+	}
+
+	var ids []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	l := &segmentLog{
+		dir:          dir,
+		segmentBytes: segmentBytes,
+	}
+
+	var (
+		messages []message
+		prevSeq  uint64
+	)
+	for _, id := range ids {
+		seg, msgs, err := readSegment(segmentPath(dir, id))
+		if err != nil {
+			return nil, nil, err
+		}
+		seg.id = id
+		l.segments = append(l.segments, seg)
+
+		// number records written before sequence numbers existed
+		prevSeq = max(prevSeq, id-1)
+		for i := range msgs {
+			if msgs[i].Seq == 0 {
+				msgs[i].Seq = prevSeq + 1
+			}
+			prevSeq = msgs[i].Seq
+		}
+		messages = append(messages, msgs...)
+	}
+
+	if len(l.segments) == 0 {
+		l.segments = append(l.segments, &segment{id: 1})
+	}
+
+	l.next = l.segments[len(l.segments)-1].id
+	for _, msg := range messages {
+		l.next = max(l.next, msg.Seq+1)
+	}
+
+	// drop any partially written record before appending after it
+	last := l.segments[len(l.segments)-1]
+	if err := os.Truncate(segmentPath(dir, last.id), last.size); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("failed to truncate segment: %w", err)
+	}
+
+	l.active, err = os.OpenFile(segmentPath(dir, last.id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open segment: %w", err)
+	}
+
+	return l, messages, nil
+}
+
+func readSegment(path string) (*segment, []message, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open segment: %w", err)
+	}
+	defer file.Close()
+
+	seg := &segment{}
+	var messages []message
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		// a trailing line without newline is a write interrupted by a crash
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			seg.size += int64(len(line))
+
+			var msg message
+			if jsonErr := json.Unmarshal(line, &msg); jsonErr != nil {
+				logger.Logger.Warn(
+					"skipping corrupted broadcast record",
+					slog.Group(
+						logKey,
+						slog.String("segment", path),
+						slog.String("error", jsonErr.Error()),
+					),
+				)
+			} else {
+				messages = append(messages, msg)
+				seg.count++
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read segment: %w", err)
+		}
+	}
+
+	return seg, messages, nil
+}
+
+// append writes msg at the end of the active segment, starting a new
+// segment first when the active one is full.
+func (l *segmentLog) append(msg message) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	line = append(line, '\n')
+
+	active := l.segments[len(l.segments)-1]
+	if active.size > 0 && l.segmentBytes > 0 && active.size+int64(len(line)) > l.segmentBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+		active = l.segments[len(l.segments)-1]
+	}
+
+	n, err := l.active.Write(line)
+	active.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	active.count++
+	l.next = max(l.next, msg.Seq+1)
+
+	return nil
+}
+
+func (l *segmentLog) rotate() error {
+	id := max(l.next, l.segments[len(l.segments)-1].id+1)
+
+	file, err := os.OpenFile(segmentPath(l.dir, id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create segment: %w", err)
+	}
+
+	_ = l.active.Close()
+	l.active = file
+	l.segments = append(l.segments, &segment{id: id})
+	return nil
+}
+
+// discard marks the n oldest retained messages as expired and deletes the
+// segments that no longer hold any retained message.
+func (l *segmentLog) discard(n int) {
+	l.dropped += n
+
+	// the active segment can only be released once a newer one exists
+	if len(l.segments) == 1 && l.segments[0].count > 0 && l.dropped >= l.segments[0].count {
+		if err := l.rotate(); err != nil {
+			logger.Logger.Warn(
+				"failed to rotate broadcast segment",
+				slog.Group(
+					logKey,
+					slog.String("dir", l.dir),
+					slog.String("error", err.Error()),
+				),
+			)
+		}
+	}
+
+	for len(l.segments) > 1 && l.dropped >= l.segments[0].count {
+		oldest := l.segments[0]
+		if err := os.Remove(segmentPath(l.dir, oldest.id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Logger.Warn(
+				"failed to remove broadcast segment",
+				slog.Group(
+					logKey,
+					slog.String("dir", l.dir),
+					slog.String("error", err.Error()),
+				),
+			)
+		}
+		l.dropped -= oldest.count
+		l.segments = l.segments[1:]
+	}
+}
+
+func (l *segmentLog) close() error {
+	if l.active == nil {
+		return nil
+	}
+	err := l.active.Close()
+	l.active = nil
+	return err
+}
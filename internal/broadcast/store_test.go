@@ -0,0 +1,204 @@
+package broadcast
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testMessage(seq uint64) message {
+	return message{
+		Seq:  seq,
+		Time: time.Date(2026, 1, 1, 0, 0, int(seq), 0, time.UTC),
+		Data: []byte(fmt.Sprintf(`{"seq":%d}`, seq)),
+	}
+}
+
+func openTestLog(t *testing.T, dir string, segmentBytes int64) (*segmentLog, []message) {
+	t.Helper()
+	l, messages, err := openSegmentLog(dir, segmentBytes)
+	if err != nil {
+		t.Fatalf("openSegmentLog: %v", err)
+	}
+	t.Cleanup(func() { l.close() })
+	return l, messages
+}
+
+func appendTestMessages(t *testing.T, l *segmentLog, seqs ...uint64) {
+	t.Helper()
+	for _, seq := range seqs {
+		if err := l.append(testMessage(seq)); err != nil {
+			t.Fatalf("append %d: %v", seq, err)
+		}
+	}
+}
+
+func seqsOf(messages []message) []uint64 {
+	seqs := []uint64{}
+	for _, msg := range messages {
+		seqs = append(seqs, msg.Seq)
+	}
+	return seqs
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, match := range matches {
+		names = append(names, filepath.Base(match))
+	}
+	return names
+}
+
+func TestSegmentLog(t *testing.T) {
+	tests := []struct {
+		name         string
+		segmentBytes int64
+		seqs         []uint64
+		discard      int
+		// written after the last record, like a write cut short by a crash
+		trailing string
+
+		wantSeqs     []uint64
+		wantNext     uint64
+		wantSegments []string
+	}{
+		{
+			name:         "empty",
+			wantSeqs:     []uint64{},
+			wantNext:     1,
+			wantSegments: []string{"00000000000000000001.log"},
+		},
+		{
+			name:         "reopen",
+			seqs:         []uint64{1, 2, 3},
+			wantSeqs:     []uint64{1, 2, 3},
+			wantNext:     4,
+			wantSegments: []string{"00000000000000000001.log"},
+		},
+		{
+			name:         "partial record is dropped",
+			seqs:         []uint64{1, 2},
+			trailing:     `{"seq":3,"da`,
+			wantSeqs:     []uint64{1, 2},
+			wantNext:     3,
+			wantSegments: []string{"00000000000000000001.log"},
+		},
+		{
+			name:         "rotation",
+			segmentBytes: 1,
+			seqs:         []uint64{1, 2, 3},
+			wantSeqs:     []uint64{1, 2, 3},
+			wantNext:     4,
+			wantSegments: []string{"00000000000000000001.log", "00000000000000000002.log", "00000000000000000003.log"},
+		},
+		{
+			name:         "retention releases whole segments",
+			segmentBytes: 1,
+			seqs:         []uint64{1, 2, 3},
+			discard:      2,
+			wantSeqs:     []uint64{3},
+			wantNext:     4,
+			wantSegments: []string{"00000000000000000003.log"},
+		},
+		{
+			name:         "retention keeps partly retained segments",
+			seqs:         []uint64{1, 2, 3},
+			discard:      2,
+			wantSeqs:     []uint64{1, 2, 3},
+			wantNext:     4,
+			wantSegments: []string{"00000000000000000001.log"},
+		},
+		{
+			name:         "sequence numbers survive an empty log",
+			seqs:         []uint64{1, 2},
+			discard:      2,
+			wantSeqs:     []uint64{},
+			wantNext:     3,
+			wantSegments: []string{"00000000000000000003.log"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			l, _ := openTestLog(t, dir, tt.segmentBytes)
+			appendTestMessages(t, l, tt.seqs...)
+			if tt.discard > 0 {
+				l.discard(tt.discard)
+			}
+			if err := l.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.trailing != "" {
+				last := segmentFiles(t, dir)
+				file, err := os.OpenFile(filepath.Join(dir, last[len(last)-1]), os.O_WRONLY|os.O_APPEND, 0o644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				file.WriteString(tt.trailing)
+				file.Close()
+			}
+
+			reopened, messages := openTestLog(t, dir, tt.segmentBytes)
+			if got := seqsOf(messages); !slices.Equal(got, tt.wantSeqs) {
+				t.Errorf("messages = %v, want %v", got, tt.wantSeqs)
+			}
+			if reopened.next != tt.wantNext {
+				t.Errorf("next = %d, want %d", reopened.next, tt.wantNext)
+			}
+			if got := segmentFiles(t, dir); !slices.Equal(got, tt.wantSegments) {
+				t.Errorf("segments = %v, want %v", got, tt.wantSegments)
+			}
+			for _, msg := range messages {
+				if want := testMessage(msg.Seq); string(msg.Data) != string(want.Data) || !msg.Time.Equal(want.Time) {
+					t.Errorf("message %d = %s at %s, want %s at %s", msg.Seq, msg.Data, msg.Time, want.Data, want.Time)
+				}
+			}
+
+			// appending after the reopen continues the log
+			appendTestMessages(t, reopened, tt.wantNext)
+			reopened.close()
+			_, messages = openTestLog(t, dir, tt.segmentBytes)
+			want := append(slices.Clone(tt.wantSeqs), tt.wantNext)
+			if got := seqsOf(messages); !slices.Equal(got, want) {
+				t.Errorf("messages after append = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestValidateEndpointName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"trials", false},
+		{"exp-1_data.v2", false},
+		{"with space", false},
+		{"", true},
+		{".", true},
+		{"..", true},
+		{"a/b", true},
+		{`a\b`, true},
+		{"../escape", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateEndpointName(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateEndpointName(%q) = %v, want error %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+}
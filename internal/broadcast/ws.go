@@ -0,0 +1,259 @@
+package broadcast
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/commonTypes"
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// time allowed to write a frame to the peer
+	wsWriteWait = 10 * time.Second
+	// time allowed to read the next pong from the peer
+	wsPongWait = 60 * time.Second
+	// send pings with this period, must be less than wsPongWait
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+var upgrader = websocket.Upgrader{
+	// native clients (MATLAB, Unity) send no Origin, and the HTTP routes
+	// accept publishes from any origin as well
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// frame sent to WebSocket clients
+type wsFrame struct {
+	// "message" for broadcast data, "binary" announcing a binary frame
+	// with the payload, "ack" for a published frame, "error" for a frame
+	// that was rejected
+	Type        string          `json:"type"`
+	Seq         uint64          `json:"seq,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+	Data        json.RawMessage `json:"data,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Detail      string          `json:"detail,omitempty"`
+}
+
+func newMessageFrame(msg message) wsFrame {
+	return wsFrame{
+		Type: "message",
+		Seq:  msg.Seq,
+		Data: jsonPayload(msg.Data),
+	}
+}
+
+// embed a payload in JSON, non JSON payloads are carried as a JSON string
+func jsonPayload(payload []byte) json.RawMessage {
+	if json.Valid(payload) {
+		return payload
+	}
+	data, _ := json.Marshal(string(payload))
+	return data
+}
+
+// Subscribe to and publish on the broadcast endpoint over a WebSocket.
+// Every frame received from the client is published like BroadcastData and
+// acknowledged with its sequence number, or answered with an error frame if
+// the endpoint rejects it. Text frames are published as JSON and binary
+// frames with the content_type query parameter, application/octet-stream by
+// default. Binary payloads are sent as a "binary" frame followed by a binary
+// frame carrying the payload.
+func WebSocketBroadcast(c *gin.Context) {
+	name := c.Param("name")
+
+	broadEndpointsMu.RLock()
+	endpoint, exists := broadEndpoints[name]
+	broadEndpointsMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("data broadcast endpoint: %s does not exist", name),
+			Detail: "",
+		})
+		return
+	}
+
+	opts, err := parseReplayOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid replay options",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	view, err := parseDataView(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid data view",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	binaryType := contentTypeBinary
+	if contentType := c.Query("content_type"); contentType != "" {
+		binaryType = parseContentType(contentType)
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// the upgrader has already replied to the client
+		logger.Logger.Warn(
+			"websocket upgrade failed: ",
+			slog.Group(
+				logKey,
+				slog.String("endpoint", name),
+				slog.String("error", err.Error()),
+			),
+		)
+		return
+	}
+	defer conn.Close()
+
+	replay, sub := endpoint.subscribe(opts, "websocket", c.ClientIP())
+	defer endpoint.unsubscribe(sub)
+
+	acks := make(chan wsFrame, 16)
+	readDone := make(chan struct{})
+	writeDone := make(chan struct{})
+	defer close(writeDone)
+
+	go wsReadLoop(conn, endpoint, binaryType, acks, readDone, writeDone)
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	// send history data
+	var lastSent uint64
+	for _, msg := range replay {
+		lastSent = msg.Seq
+		msg, ok := view.apply(msg)
+		if !ok {
+			continue
+		}
+		if err := wsWriteMessage(conn, msg); err != nil {
+			return
+		}
+	}
+
+	for {
+		select {
+		case msg := <-sub.ch:
+			if msg.Seq <= lastSent {
+				continue
+			}
+			lastSent = msg.Seq
+			msg, ok := view.apply(msg)
+			if !ok {
+				continue
+			}
+			if err := wsWriteMessage(conn, msg); err != nil {
+				return
+			}
+		case <-sub.done:
+			// disconnected by the backpressure policy
+			_ = conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "subscriber too slow"),
+				time.Now().Add(wsWriteWait),
+			)
+			return
+		case frame := <-acks:
+			if err := wsWriteFrame(conn, frame); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-readDone:
+			return
+		}
+	}
+}
+
+// publish every frame received from the client until the connection closes
+func wsReadLoop(conn *websocket.Conn, endpoint *BroadcastEndpoint, binaryType string, acks chan<- wsFrame, readDone chan<- struct{}, writeDone <-chan struct{}) {
+	defer close(readDone)
+
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logger.Logger.Warn(
+					"websocket closed unexpectedly: ",
+					slog.Group(
+						logKey,
+						slog.String("endpoint", endpoint.name),
+						slog.String("error", err.Error()),
+					),
+				)
+			}
+			return
+		}
+
+		// any frame proves the peer is alive
+		_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+
+		contentType := contentTypeJSON
+		if messageType == websocket.BinaryMessage {
+			contentType = binaryType
+		}
+
+		frame := wsFrame{Type: "ack"}
+		msg, err := endpoint.publish(data, contentType)
+		if err != nil {
+			frame = wsFrame{Type: "error", Error: "failed to publish data", Detail: err.Error()}
+			var schemaErr *schemaError
+			if errors.As(err, &schemaErr) {
+				frame.Error = schemaErr.reason
+				frame.Detail = schemaErr.detail
+			}
+		} else {
+			frame.Seq = msg.Seq
+		}
+
+		select {
+		case acks <- frame:
+		case <-writeDone:
+			return
+		}
+	}
+}
+
+// send msg as a message frame, or as a binary frame after announcing it
+func wsWriteMessage(conn *websocket.Conn, msg message) error {
+	if msg.isText() {
+		return wsWriteFrame(conn, newMessageFrame(msg))
+	}
+
+	err := wsWriteFrame(conn, wsFrame{
+		Type:        "binary",
+		Seq:         msg.Seq,
+		ContentType: msg.contentType(),
+	})
+	if err != nil {
+		return err
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return conn.WriteMessage(websocket.BinaryMessage, msg.Data)
+}
+
+func wsWriteFrame(conn *websocket.Conn, frame wsFrame) error {
+	_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return conn.WriteJSON(frame)
+}
@@ -0,0 +1,420 @@
+package cmdproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/commonTypes"
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	"github.com/Ccccraz/cogmoteGO/internal/mainpath"
+	"github.com/gin-gonic/gin"
+)
+
+// AuditEntry records one command sent through a command proxy. Request and
+// Response hold the bodies as JSON, a body which is not valid JSON is kept
+// as a JSON string and flagged by RequestText or ResponseText. RequestRaw
+// keeps the exact request, base64 encoded, when Request does not reproduce
+// it, e.g. after compacting its JSON.
+type AuditEntry struct {
+	ID           uint64          `json:"id"`
+	Time         time.Time       `json:"time"`
+	NickName     string          `json:"nickname"`
+	ClientIP     string          `json:"client_ip,omitempty"`
+	Request      json.RawMessage `json:"request,omitempty"`
+	RequestText  bool            `json:"request_text,omitempty"`
+	RequestRaw   []byte          `json:"request_raw,omitempty"`
+	Response     json.RawMessage `json:"response,omitempty"`
+	ResponseText bool            `json:"response_text,omitempty"`
+	Status       int             `json:"status"`
+	LatencyMs    float64         `json:"latency_ms"`
+	Error        string          `json:"error,omitempty"`
+	// id of the replayed entry, zero for a new command
+	ReplayOf uint64 `json:"replay_of,omitempty"`
+	// macro the command was a step of
+	Macro string `json:"macro,omitempty"`
+	// id of the scheduled job which sent the command
+	Schedule string `json:"schedule,omitempty"`
+	// proxy group the command was sent to
+	Group string `json:"group,omitempty"`
+	// caller of a command not sent over HTTP, e.g. rpc
+	Source string `json:"source,omitempty"`
+}
+
+const defaultHistoryLimit = 100
+
+var (
+	// append-only log of every command, one JSON entry per line
+	auditFile   string
+	auditMu     sync.Mutex
+	auditNextID uint64 = 1
+)
+
+func initAudit() {
+	auditFile = filepath.Join(mainpath.DataPath, "cmds", "audit.jsonl")
+
+	var lastID uint64
+	err := scanAudit(func(entry AuditEntry) bool {
+		lastID = max(lastID, entry.ID)
+		return true
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Logger.Error(
+			"failed to read command audit log: ",
+			slog.Group(
+				logKey,
+				slog.String("error", err.Error()),
+			),
+		)
+	}
+
+	auditMu.Lock()
+	auditNextID = lastID + 1
+	auditMu.Unlock()
+}
+
+// the body as stored in the audit log
+func auditBody(body []byte) (json.RawMessage, bool) {
+	if len(body) == 0 {
+		return nil, false
+	}
+	if json.Valid(body) {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, body); err == nil {
+			return compact.Bytes(), false
+		}
+	}
+	text, _ := json.Marshal(string(body))
+	return text, true
+}
+
+// the request as it was sent
+func (e AuditEntry) requestBody() ([]byte, error) {
+	if e.RequestRaw != nil {
+		return e.RequestRaw, nil
+	}
+	if !e.RequestText {
+		return e.Request, nil
+	}
+	var text string
+	if err := json.Unmarshal(e.Request, &text); err != nil {
+		return nil, err
+	}
+	return []byte(text), nil
+}
+
+// who sent a command, copied into its audit entry
+type cmdOrigin struct {
+	clientIP string
+	source   string // caller of a command not sent over HTTP
+	schedule string // id of the scheduled job
+}
+
+func newAuditEntry(origin cmdOrigin, nickname string, cmd []byte) *AuditEntry {
+	entry := &AuditEntry{
+		Time:     time.Now(),
+		NickName: nickname,
+		ClientIP: origin.clientIP,
+		Source:   origin.source,
+		Schedule: origin.schedule,
+	}
+	entry.Request, entry.RequestText = auditBody(cmd)
+	if body, err := entry.requestBody(); err != nil || !bytes.Equal(body, cmd) {
+		// replays must send the exact bytes
+		entry.RequestRaw = cmd
+	}
+	return entry
+}
+
+// append entry to the audit log, assigning its id
+func recordAudit(entry *AuditEntry) {
+	if auditFile == "" {
+		// not initialized
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	entry.ID = auditNextID
+	err := appendJSONLine(auditFile, entry)
+	if err != nil {
+		logger.Logger.Error(
+			"failed to record command: ",
+			slog.Group(
+				logKey,
+				slog.String("nickname", entry.NickName),
+				slog.String("error", err.Error()),
+			),
+		)
+		return
+	}
+	auditNextID++
+}
+
+// append v as one JSON line to the log file
+func appendJSONLine(file string, v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal log entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return fmt.Errorf("failed to create log: %w", err)
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open log: %w", err)
+	}
+	if _, err := f.Write(line); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write log: %w", err)
+	}
+	return f.Close()
+}
+
+// call fn with every line of the log file decoded into a T, in order
+// until it returns false
+func scanJSONLines[T any](file string, fn func(T) bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var entry T
+			if jsonErr := json.Unmarshal(line, &entry); jsonErr != nil {
+				// a partially written last line
+				logger.Logger.Warn(
+					"skipping invalid log entry: ",
+					slog.Group(
+						logKey,
+						slog.String("file", file),
+						slog.String("error", jsonErr.Error()),
+					),
+				)
+			} else if !fn(entry) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// call fn with every entry of the audit log in order until it returns false
+func scanAudit(fn func(AuditEntry) bool) error {
+	return scanJSONLines(auditFile, fn)
+}
+
+func findAuditEntry(id uint64) (AuditEntry, bool, error) {
+	var (
+		found AuditEntry
+		ok    bool
+	)
+	err := scanAudit(func(entry AuditEntry) bool {
+		if entry.ID == id {
+			found, ok = entry, true
+			return false
+		}
+		return true
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	return found, ok, err
+}
+
+// which entries of the audit log are asked for
+type historyQuery struct {
+	nickname string
+	from     time.Time
+	to       time.Time
+	limit    int
+}
+
+// parse the nickname, from, to (RFC 3339) and limit query parameters
+func parseHistoryQuery(c *gin.Context) (historyQuery, error) {
+	query := historyQuery{
+		nickname: c.Query("nickname"),
+		limit:    defaultHistoryLimit,
+	}
+
+	if raw := c.Query("from"); raw != "" {
+		from, err := time.Parse(time.RFC3339Nano, raw)
+		if err != nil {
+			return query, fmt.Errorf("invalid from: %s", raw)
+		}
+		query.from = from
+	}
+	if raw := c.Query("to"); raw != "" {
+		to, err := time.Parse(time.RFC3339Nano, raw)
+		if err != nil {
+			return query, fmt.Errorf("invalid to: %s", raw)
+		}
+		query.to = to
+	}
+	if raw := c.Query("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			return query, fmt.Errorf("invalid limit: %s", raw)
+		}
+		query.limit = limit
+	}
+
+	return query, nil
+}
+
+func (q historyQuery) match(entry AuditEntry) bool {
+	return q.matchAt(entry.NickName, entry.Time)
+}
+
+// whether something sent to nickname at t is asked for
+func (q historyQuery) matchAt(nickname string, t time.Time) bool {
+	if q.nickname != "" && nickname != q.nickname {
+		return false
+	}
+	if !q.from.IsZero() && t.Before(q.from) {
+		return false
+	}
+	if !q.to.IsZero() && t.After(q.to) {
+		return false
+	}
+	return true
+}
+
+// GetCmdHistory lists the latest recorded commands matching the query, oldest
+// first
+func GetCmdHistory(c *gin.Context) {
+	query, err := parseHistoryQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid history query",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	entries := make([]AuditEntry, 0)
+	err = scanAudit(func(entry AuditEntry) bool {
+		if query.match(entry) {
+			entries = append(entries, entry)
+			if len(entries) > query.limit {
+				entries = entries[1:]
+			}
+		}
+		return true
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  "failed to read command history",
+			Detail: err.Error(),
+		})
+		logger.Logger.Error(
+			"failed to read command history: ",
+			slog.Group(
+				logKey,
+				slog.String("error", err.Error()),
+			),
+		)
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// look the entry of the :id parameter up, answering the request when it
+// cannot be found
+func lookupAuditEntry(c *gin.Context) (AuditEntry, bool) {
+	raw := c.Param("id")
+	id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid history id",
+			Detail: raw,
+		})
+		return AuditEntry{}, false
+	}
+
+	entry, exist, err := findAuditEntry(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  "failed to read command history",
+			Detail: err.Error(),
+		})
+		return AuditEntry{}, false
+	}
+	if !exist {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("command %d not found", id),
+			Detail: "",
+		})
+		return AuditEntry{}, false
+	}
+
+	return entry, true
+}
+
+func GetCmdHistoryEntry(c *gin.Context) {
+	entry, ok := lookupAuditEntry(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+// ReplayCmd sends a recorded command again, to the same command proxy unless
+// the nickname query parameter names another one. The replay is recorded as
+// a new entry.
+func ReplayCmd(c *gin.Context) {
+	handleStart := time.Now()
+
+	entry, ok := lookupAuditEntry(c)
+	if !ok {
+		return
+	}
+
+	cmd, err := entry.requestBody()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("cannot read recorded command %d", entry.ID),
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	nickname := entry.NickName
+	if target := c.Query("nickname"); target != "" {
+		nickname = target
+	}
+
+	logger.Logger.Info(
+		"replaying command: ",
+		slog.Group(
+			logKey,
+			slog.String("nickname", nickname),
+			slog.Uint64("id", entry.ID),
+		),
+	)
+
+	forwardCmd(c, nickname, cmd, entry.ID, handleStart)
+}
@@ -22,8 +22,42 @@ type Endpoint struct {
 	NickName string `json:"nickname" binding:"required"`
 	Hostname string `json:"hostname" binding:"required"`
 	Port     uint   `json:"port" binding:"required"`
+	// Socket used to talk to the task server, req (default) or dealer
+	Mode string `json:"mode,omitempty"`
+	// Current state of the proxy, only reported
+	State string `json:"state,omitempty"`
+	// Whether the proxy is declared in the config file, only reported
+	Static bool `json:"static,omitempty"`
+	// Z85 encoded CURVE public key of the task server, traffic is encrypted
+	// when set
+	ServerKey string `json:"server_key,omitempty"`
+	Timeouts
 }
 
+func (e *Endpoint) validate() error {
+	switch e.Mode {
+	case "":
+		e.Mode = ModeREQ
+	case ModeREQ, ModeDealer:
+	default:
+		return fmt.Errorf("unsupported mode: %s", e.Mode)
+	}
+	if e.ServerKey != "" {
+		if err := validateCurveKey(e.ServerKey); err != nil {
+			return fmt.Errorf("invalid server key: %w", err)
+		}
+	}
+	return e.Timeouts.validate()
+}
+
+// proxy modes
+const (
+	// strict request-reply with a REQ socket, one command at a time
+	ModeREQ = "req"
+	// DEALER socket with request ids, many commands in flight
+	ModeDealer = "dealer"
+)
+
 type HandshakeREP struct {
 	Response string `json:"response"`
 }
@@ -32,12 +66,94 @@ type HandshakeREQ struct {
 	Request string `json:"request"`
 }
 
-type ReqClient struct {
+// cmdClient is a connection to a task server, see ReqClient and DealerClient
+type cmdClient interface {
+	Send(msg []byte) ([]byte, error)
+	// send msg with the given limits instead of the proxy ones
+	send(msg []byte, opts sendOptions) ([]byte, error)
+	Close() error
+	handShake() error
+	base() *clientBase
+}
+
+// state shared by every kind of command proxy client
+type clientBase struct {
+	nickname string
 	hostname string
 	port     uint
+	mode     string
+	static   bool // declared in the config file, never persisted
+	timeouts Timeouts
+	curve    *curveKeys // nil for plaintext
+
+	closed atomic.Bool
+	done   chan struct{} // closed when the client is closed
+
+	stateMu  sync.Mutex
+	state    string    // one of the State constants
+	failures int       // consecutive failed heartbeats and commands
+	lastSeen time.Time // time of the latest answer of the task server
+
+	metrics proxyMetrics
+}
+
+func (b *clientBase) init(hostname string, port uint, mode string, curve *curveKeys) {
+	b.hostname = hostname
+	b.port = port
+	b.mode = mode
+	b.curve = curve
+	b.done = make(chan struct{})
+	b.state = StateConnecting
+}
+
+func (b *clientBase) base() *clientBase {
+	return b
+}
+
+func (b *clientBase) endpoint() Endpoint {
+	endpoint := Endpoint{
+		NickName: b.nickname,
+		Hostname: b.hostname,
+		Port:     b.port,
+		Mode:     b.mode,
+		Static:   b.static,
+		Timeouts: b.timeouts,
+	}
+	if b.curve != nil {
+		endpoint.ServerKey = b.curve.server
+	}
+	return endpoint
+}
+
+// create the client of a validated endpoint, it still needs to be
+// registered and kept alive
+func newCmdClient(endpoint Endpoint) (cmdClient, error) {
+	curve, err := loadCurveKeys(endpoint.ServerKey)
+	if err != nil {
+		return nil, err
+	}
 
-	available atomic.Bool
-	closed    atomic.Bool
+	var client cmdClient
+	switch endpoint.Mode {
+	case ModeREQ:
+		client, err = createREQ(endpoint.Hostname, endpoint.Port, curve)
+	case ModeDealer:
+		client, err = createDealer(endpoint.Hostname, endpoint.Port, curve)
+	default:
+		return nil, fmt.Errorf("unsupported mode: %s", endpoint.Mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client.base().nickname = endpoint.NickName
+	client.base().static = endpoint.Static
+	client.base().timeouts = endpoint.Timeouts
+	return client, nil
+}
+
+type ReqClient struct {
+	clientBase
 
 	context *zmq.Context
 	socket  *zmq.Socket
@@ -46,7 +162,7 @@ type ReqClient struct {
 }
 
 var (
-	reqClientMap      = make(map[string]*ReqClient)
+	reqClientMap      = make(map[string]cmdClient)
 	reqClientMapMutex sync.RWMutex
 	logKey            = "cmdProxies"
 	cfg               config.Config
@@ -66,40 +182,40 @@ func lazyPirateMaxRetries() int {
 }
 
 func lazyPirateRetryInterval() time.Duration {
-	d := time.Duration(cfg.Proxy.RetryInterval)
+	d := time.Duration(cfg.Proxy.RetryInterval) * time.Millisecond
 	if d <= 0 {
 		return 200 * time.Millisecond
 	}
 	return d
 }
 
-func applyHandshakeTimeouts(s *zmq.Socket) error {
+func applyHandshakeTimeouts(s *zmq.Socket, timeout time.Duration) error {
 	if s == nil {
 		return nil
 	}
-	if err := s.SetSndtimeo(time.Duration(cfg.Proxy.HandshakeTimeout) * time.Millisecond); err != nil {
+	if err := s.SetSndtimeo(timeout); err != nil {
 		return fmt.Errorf("failed to set handshake send timeout: %w", err)
 	}
-	if err := s.SetRcvtimeo(time.Duration(cfg.Proxy.HandshakeTimeout) * time.Millisecond); err != nil {
+	if err := s.SetRcvtimeo(timeout); err != nil {
 		return fmt.Errorf("failed to set handshake recv timeout: %w", err)
 	}
 	return nil
 }
 
-func applyMsgTimeouts(s *zmq.Socket) error {
+func applyMsgTimeouts(s *zmq.Socket, timeout time.Duration) error {
 	if s == nil {
 		return nil
 	}
-	if err := s.SetSndtimeo(time.Duration(cfg.Proxy.MsgTimeout) * time.Millisecond); err != nil {
+	if err := s.SetSndtimeo(timeout); err != nil {
 		return fmt.Errorf("failed to set msg send timeout: %w", err)
 	}
-	if err := s.SetRcvtimeo(time.Duration(cfg.Proxy.MsgTimeout) * time.Millisecond); err != nil {
+	if err := s.SetRcvtimeo(timeout); err != nil {
 		return fmt.Errorf("failed to set msg recv timeout: %w", err)
 	}
 	return nil
 }
 
-func createREQ(hostname string, port uint) (*ReqClient, error) {
+func createREQ(hostname string, port uint, curve *curveKeys) (*ReqClient, error) {
 	zctx, err := zmq.NewContext()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create context: %w", err)
@@ -111,18 +227,31 @@ func createREQ(hostname string, port uint) (*ReqClient, error) {
 		return nil, fmt.Errorf("failed to create socket: %w", err)
 	}
 
+	// an unanswered command must not block closing the proxy
+	if err := s.SetLinger(0); err != nil {
+		_ = s.Close()
+		_ = zctx.Term()
+		return nil, fmt.Errorf("failed to set linger: %w", err)
+	}
+
+	if err := curve.apply(s); err != nil {
+		_ = s.Close()
+		_ = zctx.Term()
+		return nil, err
+	}
+
 	if err := s.Connect(fmt.Sprintf("tcp://%s:%d", hostname, port)); err != nil {
 		_ = s.Close()
 		_ = zctx.Term()
 		return nil, fmt.Errorf("failed to connect to server: %w", err)
 	}
 
-	return &ReqClient{
-		hostname: hostname,
-		port:     port,
-		context:  zctx,
-		socket:   s,
-	}, nil
+	r := &ReqClient{
+		context: zctx,
+		socket:  s,
+	}
+	r.init(hostname, port, ModeREQ, curve)
+	return r, nil
 }
 
 // Lazy Pirate: on timeout/EFSM, discard REQ socket and recreate it, then retry.
@@ -138,19 +267,30 @@ func (r *ReqClient) recreateSocketLocked() error {
 		_ = r.socket.Close()
 		r.socket = nil
 	}
+	r.metrics.addSocketRecreation()
 
 	s, err := r.context.NewSocket(zmq.REQ)
 	if err != nil {
 		return fmt.Errorf("failed to recreate socket: %w", err)
 	}
 
+	if err := s.SetLinger(0); err != nil {
+		_ = s.Close()
+		return fmt.Errorf("failed to set linger: %w", err)
+	}
+
+	if err := r.curve.apply(s); err != nil {
+		_ = s.Close()
+		return err
+	}
+
 	if err := s.Connect(fmt.Sprintf("tcp://%s:%d", r.hostname, r.port)); err != nil {
 		_ = s.Close()
 		return fmt.Errorf("failed to reconnect to server: %w", err)
 	}
 
 	// Msg timeouts are applied after the initial handshake.
-	if err := applyMsgTimeouts(s); err != nil {
+	if err := applyMsgTimeouts(s, r.sendOptions().timeout); err != nil {
 		_ = s.Close()
 		return err
 	}
@@ -167,16 +307,22 @@ func (r *ReqClient) handShake() error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if r.closed.Load() || r.socket == nil {
+	if r.closed.Load() {
 		return ErrClientClosed
 	}
+	if r.socket == nil {
+		// an earlier reconnection failed
+		if err := r.recreateSocketLocked(); err != nil {
+			return err
+		}
+	}
 
 	const (
 		expectedRequest  = "Hello"
 		expectedResponse = "World"
 	)
 
-	if err := applyHandshakeTimeouts(r.socket); err != nil {
+	if err := applyHandshakeTimeouts(r.socket, r.handshakeTimeout()); err != nil {
 		return err
 	}
 
@@ -189,14 +335,17 @@ func (r *ReqClient) handShake() error {
 	}
 
 	if _, err := r.socket.SendBytes(requestJson, 0); err != nil {
+		// the REQ socket cannot be reused after a failed exchange
+		_ = r.recreateSocketLocked()
 		return fmt.Errorf("failed to send handshake request: %w", err)
 	}
 
 	msgJson, err := r.socket.RecvBytes(0)
-	if len(msgJson) == 0 {
-		return fmt.Errorf("empty handshake response")
-	} else if err != nil {
+	if err != nil {
+		_ = r.recreateSocketLocked()
 		return fmt.Errorf("failed to receive handshake response: %w", err)
+	} else if len(msgJson) == 0 {
+		return fmt.Errorf("empty handshake response")
 	}
 
 	var msg HandshakeREP
@@ -208,10 +357,7 @@ func (r *ReqClient) handShake() error {
 		return fmt.Errorf("wrong handshake response: %s", msg.Response)
 	}
 
-	r.available.Store(true)
-
-	if err := applyMsgTimeouts(r.socket); err != nil {
-		r.available.Store(false)
+	if err := applyMsgTimeouts(r.socket, r.sendOptions().timeout); err != nil {
 		return err
 	}
 
@@ -229,28 +375,39 @@ func (r *ReqClient) handShake() error {
 }
 
 func (r *ReqClient) Send(msg []byte) ([]byte, error) {
+	return r.send(msg, r.sendOptions())
+}
+
+func (r *ReqClient) send(msg []byte, opts sendOptions) ([]byte, error) {
 	if r.closed.Load() {
 		return nil, ErrClientClosed
 	}
-	if !r.available.Load() {
+	if !r.usable() {
 		return nil, ErrClientUnavailable
 	}
 
-	maxRetries := lazyPirateMaxRetries()
-	retryInterval := lazyPirateRetryInterval()
+	maxRetries := opts.maxRetries
+	retryInterval := opts.retryInterval
 	var lastErr error
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
+		if attempt > 0 {
+			r.metrics.addRetry()
+		}
 		r.mutex.Lock()
 
 		if r.closed.Load() || r.socket == nil {
 			r.mutex.Unlock()
 			return nil, ErrClientClosed
 		}
-		if !r.available.Load() {
+		if !r.usable() {
 			r.mutex.Unlock()
 			return nil, ErrClientUnavailable
 		}
+		if err := applyMsgTimeouts(r.socket, opts.timeout); err != nil {
+			r.mutex.Unlock()
+			return nil, err
+		}
 
 		_, err := r.socket.SendBytes(msg, 0)
 		if err != nil {
@@ -323,7 +480,7 @@ func (r *ReqClient) Close() error {
 		return nil
 	}
 
-	r.available.Store(false)
+	close(r.done)
 
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
@@ -363,12 +520,10 @@ func GetAllCmdProxies(c *gin.Context) {
 	}
 
 	var reqClientInfos []Endpoint
-	for nickname, reqClient := range reqClientMap {
-		reqClientInfos = append(reqClientInfos, Endpoint{
-			NickName: nickname,
-			Hostname: reqClient.hostname,
-			Port:     reqClient.port,
-		})
+	for _, reqClient := range reqClientMap {
+		info := reqClient.base().endpoint()
+		info.State = reqClient.base().currentState()
+		reqClientInfos = append(reqClientInfos, info)
 	}
 
 	c.JSON(http.StatusOK, reqClientInfos)
@@ -384,6 +539,16 @@ func createCmdProxy(c *gin.Context) {
 		return
 	}
 
+	endpoint.State = ""
+	endpoint.Static = false
+	if err := endpoint.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid proxy endpoint",
+			Detail: err.Error(),
+		})
+		return
+	}
+
 	reqClientMapMutex.RLock()
 	_, exist := reqClientMap[endpoint.NickName]
 	reqClientMapMutex.RUnlock()
@@ -395,7 +560,7 @@ func createCmdProxy(c *gin.Context) {
 		return
 	}
 
-	client, err := createREQ(endpoint.Hostname, endpoint.Port)
+	client, err := newCmdClient(endpoint)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
 			Error:  fmt.Sprintf("failed to create command proxy %s", endpoint.NickName),
@@ -411,6 +576,7 @@ func createCmdProxy(c *gin.Context) {
 			slog.String("nickname", endpoint.NickName),
 			slog.String("hostname", endpoint.Hostname),
 			slog.Int("port", int(endpoint.Port)),
+			slog.String("mode", endpoint.Mode),
 		),
 	)
 
@@ -425,21 +591,19 @@ func createCmdProxy(c *gin.Context) {
 		return
 	}
 	reqClientMap[endpoint.NickName] = client
+	if err := saveProxiesLocked(); err != nil {
+		delete(reqClientMap, endpoint.NickName)
+		reqClientMapMutex.Unlock()
+		_ = client.Close()
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  fmt.Sprintf("failed to save command proxy %s", endpoint.NickName),
+			Detail: err.Error(),
+		})
+		return
+	}
 	reqClientMapMutex.Unlock()
 
-	go func(nick string, cl *ReqClient) {
-		if err := cl.handShake(); err != nil {
-			logger.Logger.Error(
-				"handshake failed: ",
-				slog.Group(
-					logKey,
-					slog.String("nickname", nick),
-					slog.String("error", err.Error()),
-				),
-			)
-			_ = destroyReqClient(nick, cl)
-		}
-	}(endpoint.NickName, client)
+	go keepAlive(client)
 
 	c.Status(http.StatusCreated)
 }
@@ -448,27 +612,113 @@ func sendCmd(c *gin.Context) {
 	handleStart := time.Now()
 	nickname := c.Param("nickname")
 
+	cmd, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "cannot get command data from request body",
+			Detail: err.Error(),
+		})
+		logger.Logger.Error(
+			"cannot get command data from request body: ",
+			slog.Group(logKey, slog.String("nickname", nickname)),
+		)
+		return
+	}
+
+	forwardCmd(c, nickname, cmd, 0, handleStart)
+}
+
+// send cmd to the command proxy nickname and answer with its reply, the
+// call is recorded in the audit log. replayOf is the audit id of the
+// replayed command, zero for a new one.
+func forwardCmd(c *gin.Context, nickname string, cmd []byte, replayOf uint64, handleStart time.Time) {
+	entry := newAuditEntry(cmdOrigin{clientIP: c.ClientIP()}, nickname, cmd)
+	entry.ReplayOf = replayOf
+
+	result := dispatchCmd(entry, cmd, func(opts sendOptions) (sendOptions, error) {
+		return parseSendOptions(c, opts)
+	})
+	if result.failed() {
+		c.JSON(result.status, result.apiErr)
+		return
+	}
+
+	logger.Logger.Debug(
+		"command send success: ",
+		slog.Group(
+			logKey,
+			slog.String("nickname", nickname),
+			slog.String("handleDuration", (time.Since(handleStart)-result.latency).String()),
+			slog.String("sendDuration", result.latency.String()),
+		),
+	)
+
+	c.Data(result.status, "application/json", result.data)
+}
+
+// SendCommand sends cmd to the command proxy nickname like a POST to
+// /cmds/proxies/:nickname, the call is recorded in the audit log with source
+// as its caller. On failure the HTTP status the API would answer with is
+// returned along with the error.
+func SendCommand(nickname string, cmd []byte, source string) ([]byte, int, error) {
+	entry := newAuditEntry(cmdOrigin{source: source}, nickname, cmd)
+	result := dispatchCmd(entry, cmd, nil)
+	if result.failed() {
+		return nil, result.status, errors.New(entry.Error)
+	}
+	return result.data, result.status, nil
+}
+
+// outcome of a command sent through a command proxy
+type cmdResult struct {
+	status  int
+	data    []byte
+	apiErr  commonTypes.APIError // set when the command failed
+	latency time.Duration
+}
+
+func (r cmdResult) failed() bool {
+	return r.apiErr.Error != ""
+}
+
+// send cmd to the command proxy entry.NickName and record the call in the
+// audit log. options may override the limits of the proxy, nil keeps them.
+func dispatchCmd(entry *AuditEntry, cmd []byte, options func(sendOptions) (sendOptions, error)) (result cmdResult) {
+	nickname := entry.NickName
+	defer func() {
+		entry.Status = result.status
+		entry.LatencyMs = float64(result.latency.Microseconds()) / 1000
+		if result.failed() {
+			entry.Error = result.apiErr.Error
+			if result.apiErr.Detail != "" {
+				entry.Error += ": " + result.apiErr.Detail
+			}
+		} else {
+			entry.Response, entry.ResponseText = auditBody(result.data)
+		}
+		recordAudit(entry)
+	}()
+
 	reqClientMapMutex.RLock()
 	reqClient, exist := reqClientMap[nickname]
 	reqClientMapMutex.RUnlock()
 
 	if !exist {
-		c.JSON(http.StatusNotFound, commonTypes.APIError{
-			Error:  fmt.Sprintf("command proxy %s not found", nickname),
-			Detail: "",
-		})
 		logger.Logger.Error(
 			"command proxy not found: ",
 			slog.Group(logKey, slog.String("nickname", nickname)),
 		)
-		return
+		return cmdResult{
+			status: http.StatusNotFound,
+			apiErr: commonTypes.APIError{
+				Error:  fmt.Sprintf("command proxy %s not found", nickname),
+				Detail: "",
+			},
+		}
 	}
 
-	if !reqClient.available.Load() || reqClient.closed.Load() {
-		c.JSON(http.StatusServiceUnavailable, commonTypes.APIError{
-			Error:  fmt.Sprintf("command proxy %s is not available", nickname),
-			Detail: "",
-		})
+	if !reqClient.base().usable() {
+		reqClient.base().metrics.observe(resultUnavailable, 0)
 		logger.Logger.Error(
 			"command proxy not available: ",
 			slog.Group(
@@ -477,55 +727,78 @@ func sendCmd(c *gin.Context) {
 				slog.String("error", "command proxy is not available"),
 			),
 		)
-		return
+		return cmdResult{
+			status: http.StatusServiceUnavailable,
+			apiErr: commonTypes.APIError{
+				Error:  fmt.Sprintf("command proxy %s is not available", nickname),
+				Detail: fmt.Sprintf("state: %s", reqClient.base().currentState()),
+			},
+		}
 	}
 
-	cmd, err := c.GetRawData()
-	if err != nil {
-		c.JSON(http.StatusBadRequest, commonTypes.APIError{
-			Error:  "cannot get command data from request body",
-			Detail: err.Error(),
-		})
-		logger.Logger.Error(
-			"cannot get command data from request body: ",
-			slog.Group(logKey, slog.String("nickname", nickname)),
-		)
-		return
+	opts := reqClient.base().sendOptions()
+	if options != nil {
+		var err error
+		opts, err = options(opts)
+		if err != nil {
+			logger.Logger.Error(
+				"invalid command options: ",
+				slog.Group(
+					logKey,
+					slog.String("nickname", nickname),
+					slog.String("error", err.Error()),
+				),
+			)
+			return cmdResult{
+				status: http.StatusBadRequest,
+				apiErr: commonTypes.APIError{
+					Error:  "invalid command options",
+					Detail: err.Error(),
+				},
+			}
+		}
 	}
-	handleElapsed := time.Since(handleStart)
 
 	sendStart := time.Now()
-	result, err := reqClient.Send(cmd)
+	data, err := reqClient.send(cmd, opts)
+	latency := time.Since(sendStart)
 	if err != nil {
 		if errors.Is(err, ErrClientClosed) || errors.Is(err, ErrClientUnavailable) {
-			c.JSON(http.StatusServiceUnavailable, commonTypes.APIError{
-				Error:  fmt.Sprintf("command proxy %s is not available", nickname),
-				Detail: err.Error(),
-			})
-			return
+			reqClient.base().metrics.observe(resultUnavailable, 0)
+			return cmdResult{
+				status: http.StatusServiceUnavailable,
+				apiErr: commonTypes.APIError{
+					Error:  fmt.Sprintf("command proxy %s is not available", nickname),
+					Detail: err.Error(),
+				},
+				latency: latency,
+			}
 		}
 
 		if errors.Is(err, ErrMaxRetriesExceeded) || isTimeoutError(err) {
+			// the proxy stays registered, heartbeats find out when the task
+			// server is back
+			reqClient.base().recordFailure()
+			reqClient.base().metrics.observe(resultTimeout, latency)
 			logger.Logger.Error(
-				"command proxy timed out (lazy pirate retries exhausted), destroying req client",
+				"command proxy timed out (lazy pirate retries exhausted)",
 				slog.Group(
 					logKey,
 					slog.String("nickname", nickname),
 					slog.String("detail", err.Error()),
 				),
 			)
-			_ = destroyReqClient(nickname, reqClient)
-			c.JSON(http.StatusGatewayTimeout, commonTypes.APIError{
-				Error:  fmt.Sprintf("command proxy %s timed out", nickname),
-				Detail: err.Error(),
-			})
-			return
+			return cmdResult{
+				status: http.StatusGatewayTimeout,
+				apiErr: commonTypes.APIError{
+					Error:  fmt.Sprintf("command proxy %s timed out", nickname),
+					Detail: err.Error(),
+				},
+				latency: latency,
+			}
 		}
 
-		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
-			Error:  fmt.Sprintf("failed to send command to command proxy %s", nickname),
-			Detail: err.Error(),
-		})
+		reqClient.base().metrics.observe(resultError, latency)
 		logger.Logger.Error(
 			"failed to send command to command proxy: ",
 			slog.Group(
@@ -534,21 +807,24 @@ func sendCmd(c *gin.Context) {
 				slog.String("detail", err.Error()),
 			),
 		)
-		return
+		return cmdResult{
+			status: http.StatusInternalServerError,
+			apiErr: commonTypes.APIError{
+				Error:  fmt.Sprintf("failed to send command to command proxy %s", nickname),
+				Detail: err.Error(),
+			},
+			latency: latency,
+		}
 	}
 
-	sendElapsed := time.Since(sendStart)
-	logger.Logger.Debug(
-		"command send success: ",
-		slog.Group(
-			logKey,
-			slog.String("nickname", nickname),
-			slog.String("handleDuration", handleElapsed.String()),
-			slog.String("sendDuration", sendElapsed.String()),
-		),
-	)
+	reqClient.base().recordSuccess()
+	reqClient.base().metrics.observe(resultSuccess, latency)
 
-	c.Data(http.StatusCreated, "application/json", result)
+	return cmdResult{
+		status:  http.StatusCreated,
+		data:    data,
+		latency: latency,
+	}
 }
 
 func DeleteAllCmdProxies(c *gin.Context) {
@@ -560,12 +836,18 @@ func DeleteAllCmdProxies(c *gin.Context) {
 		return
 	}
 
-	snapshot := make(map[string]*ReqClient, len(reqClientMap))
+	snapshot := make(map[string]cmdClient, len(reqClientMap))
 	for nick, client := range reqClientMap {
 		snapshot[nick] = client
 	}
 
-	reqClientMap = make(map[string]*ReqClient)
+	reqClientMap = make(map[string]cmdClient)
+	if err := saveProxiesLocked(); err != nil {
+		logger.Logger.Warn(
+			"failed to save command proxies: ",
+			slog.Group(logKey, slog.String("error", err.Error())),
+		)
+	}
 	reqClientMapMutex.Unlock()
 
 	var (
@@ -576,7 +858,7 @@ func DeleteAllCmdProxies(c *gin.Context) {
 
 	for nick, client := range snapshot {
 		wg.Add(1)
-		go func(n string, cl *ReqClient) {
+		go func(n string, cl cmdClient) {
 			defer wg.Done()
 			if err := destroyReqClient(n, cl); err != nil {
 				errMux.Lock()
@@ -645,16 +927,20 @@ func isTimeoutError(err error) bool {
 	return false
 }
 
-func destroyReqClient(nickname string, client *ReqClient) error {
+func destroyReqClient(nickname string, client cmdClient) error {
 	if client == nil {
 		return nil
 	}
 
-	client.available.Store(false)
-
 	reqClientMapMutex.Lock()
 	if stored, exist := reqClientMap[nickname]; exist && stored == client {
 		delete(reqClientMap, nickname)
+		if err := saveProxiesLocked(); err != nil {
+			logger.Logger.Warn(
+				"failed to save command proxies: ",
+				slog.Group(logKey, slog.String("error", err.Error())),
+			)
+		}
 	}
 	reqClientMapMutex.Unlock()
 
@@ -677,6 +963,30 @@ func RegisterRoutes(r gin.IRouter, config config.Config) {
 	r.GET("/cmds/proxies", GetAllCmdProxies)
 	r.POST("/cmds/proxies", createCmdProxy)
 	r.POST("/cmds/proxies/:nickname", sendCmd)
+	r.GET("/cmds/proxies/:nickname/stats", GetCmdProxyStats)
 	r.DELETE("/cmds/proxies", DeleteAllCmdProxies)
 	r.DELETE("/cmds/proxies/:nickname", DeleteCmdProxy)
+	r.GET("/cmds/history", GetCmdHistory)
+	r.GET("/cmds/history/:id", GetCmdHistoryEntry)
+	r.POST("/cmds/history/:id/replay", ReplayCmd)
+	r.GET("/cmds/macros", GetMacros)
+	r.POST("/cmds/macros", CreateMacro)
+	r.GET("/cmds/macros/:macro", GetMacro)
+	r.PUT("/cmds/macros/:macro", UpdateMacro)
+	r.DELETE("/cmds/macros/:macro", DeleteMacro)
+	r.POST("/cmds/macros/:macro/run", RunMacro)
+	r.GET("/cmds/schedules", GetSchedules)
+	r.POST("/cmds/schedules", CreateSchedule)
+	r.GET("/cmds/schedules/history", GetScheduleHistory)
+	r.GET("/cmds/schedules/:id", GetSchedule)
+	r.DELETE("/cmds/schedules/:id", CancelSchedule)
+	r.GET("/cmds/schedules/:id/history", GetScheduleHistory)
+	r.GET("/cmds/groups", GetGroups)
+	r.POST("/cmds/groups", CreateGroup)
+	r.GET("/cmds/groups/:group", GetGroup)
+	r.PUT("/cmds/groups/:group", UpdateGroup)
+	r.DELETE("/cmds/groups/:group", DeleteGroup)
+	r.POST("/cmds/groups/:group/send", SendGroupCmd)
+	r.GET("/cmds/stats", GetAllCmdProxyStats)
+	r.GET("/cmds/metrics", GetCmdProxyMetrics)
 }
@@ -0,0 +1,188 @@
+package cmdproxy
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func bitsOf(values ...int) uint64 {
+	var bits uint64
+	for _, v := range values {
+		bits |= 1 << uint(v)
+	}
+	return bits
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    cronSchedule
+		wantErr bool
+	}{
+		{
+			expr: "* * * * *",
+			want: cronSchedule{
+				minute: bitsOf(seq(0, 59, 1)...), hour: bitsOf(seq(0, 23, 1)...),
+				dom: bitsOf(seq(1, 31, 1)...), month: bitsOf(seq(1, 12, 1)...),
+				dow: bitsOf(seq(0, 7, 1)...), domStar: true, dowStar: true,
+			},
+		},
+		{
+			expr: "*/15 9-17 1,15 */3 1-5",
+			want: cronSchedule{
+				minute: bitsOf(0, 15, 30, 45), hour: bitsOf(seq(9, 17, 1)...),
+				dom: bitsOf(1, 15), month: bitsOf(1, 4, 7, 10),
+				dow: bitsOf(1, 2, 3, 4, 5),
+			},
+		},
+		{
+			// n/step runs to the end of the range
+			expr: "5/20 0-10/5 * * *",
+			want: cronSchedule{
+				minute: bitsOf(5, 25, 45), hour: bitsOf(0, 5, 10),
+				dom: bitsOf(seq(1, 31, 1)...), month: bitsOf(seq(1, 12, 1)...),
+				dow: bitsOf(seq(0, 7, 1)...), domStar: true, dowStar: true,
+			},
+		},
+		{
+			// 7 is Sunday like 0
+			expr: "0 0 * * 7",
+			want: cronSchedule{
+				minute: bitsOf(0), hour: bitsOf(0),
+				dom: bitsOf(seq(1, 31, 1)...), month: bitsOf(seq(1, 12, 1)...),
+				dow: bitsOf(0, 7), domStar: true,
+			},
+		},
+		{
+			// */n counts as a star for the day of month / day of week rule
+			expr: "0 0 */2 * 5",
+			want: cronSchedule{
+				minute: bitsOf(0), hour: bitsOf(0),
+				dom: bitsOf(seq(1, 31, 2)...), month: bitsOf(seq(1, 12, 1)...),
+				dow: bitsOf(5), domStar: true,
+			},
+		},
+		{
+			expr: "@weekly",
+			want: cronSchedule{
+				minute: bitsOf(0), hour: bitsOf(0),
+				dom: bitsOf(seq(1, 31, 1)...), month: bitsOf(seq(1, 12, 1)...),
+				dow: bitsOf(0), domStar: true,
+			},
+		},
+		{expr: "", wantErr: true},
+		{expr: "* * * *", wantErr: true},
+		{expr: "* * * * * *", wantErr: true},
+		{expr: "60 * * * *", wantErr: true},
+		{expr: "* 24 * * *", wantErr: true},
+		{expr: "* * 0 * *", wantErr: true},
+		{expr: "* * * 13 *", wantErr: true},
+		{expr: "* * * * 8", wantErr: true},
+		{expr: "5-1 * * * *", wantErr: true},
+		{expr: "*/0 * * * *", wantErr: true},
+		{expr: "*/x * * * *", wantErr: true},
+		{expr: "a * * * *", wantErr: true},
+		{expr: "1-x * * * *", wantErr: true},
+		{expr: "@reboot", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := parseCron(tt.expr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseCron(%q) = %+v, want error", tt.expr, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCron(%q): %v", tt.expr, err)
+			}
+			if *got != tt.want {
+				t.Errorf("parseCron(%q) = %+v, want %+v", tt.expr, *got, tt.want)
+			}
+		})
+	}
+}
+
+func seq(from, to, step int) []int {
+	var values []int
+	for v := from; v <= to; v += step {
+		values = append(values, v)
+	}
+	return values
+}
+
+func TestCronNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := func(s string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	ny := func(s string) time.Time {
+		return utc(s).In(newYork)
+	}
+
+	// 2026-01-01 is a Thursday
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time // zero when nothing matches
+	}{
+		{"every minute", "* * * * *", utc("2026-01-01T10:00:30Z"), utc("2026-01-01T10:01:00Z")},
+		{"strictly after", "0 12 * * *", utc("2026-01-01T12:00:00Z"), utc("2026-01-02T12:00:00Z")},
+		{"step", "*/15 * * * *", utc("2026-01-01T10:07:00Z"), utc("2026-01-01T10:15:00Z")},
+		{"step wraps the hour", "*/15 * * * *", utc("2026-01-01T10:45:00Z"), utc("2026-01-01T11:00:00Z")},
+		{"value with step", "5/20 * * * *", utc("2026-01-01T10:46:00Z"), utc("2026-01-01T11:05:00Z")},
+		{"wraps the year", "0 0 1 1 *", utc("2026-06-01T00:00:00Z"), utc("2027-01-01T00:00:00Z")},
+		{"weekdays", "0 9 * * 1-5", utc("2026-01-02T09:00:00Z"), utc("2026-01-05T09:00:00Z")},
+		{"sunday as 0", "0 0 * * 0", utc("2026-01-01T00:00:00Z"), utc("2026-01-04T00:00:00Z")},
+		{"sunday as 7", "0 0 * * 7", utc("2026-01-01T00:00:00Z"), utc("2026-01-04T00:00:00Z")},
+		{"day of month or day of week, friday first", "0 0 13 * 5", utc("2026-01-01T00:00:00Z"), utc("2026-01-02T00:00:00Z")},
+		{"day of month or day of week, 13th first", "0 0 13 * 5", utc("2026-01-10T00:00:00Z"), utc("2026-01-13T00:00:00Z")},
+		{"star step day of month and day of week", "0 0 */2 * 5", utc("2026-01-01T00:00:00Z"), utc("2026-01-09T00:00:00Z")},
+		{"star day of week", "0 0 13 * *", utc("2026-01-01T00:00:00Z"), utc("2026-01-13T00:00:00Z")},
+		{"skips short months", "0 0 31 * *", utc("2026-02-01T00:00:00Z"), utc("2026-03-31T00:00:00Z")},
+		{"leap day", "0 0 29 2 *", utc("2026-03-01T00:00:00Z"), utc("2028-02-29T00:00:00Z")},
+		{"never", "0 0 30 2 *", utc("2026-01-01T00:00:00Z"), time.Time{}},
+		{"alias", "@daily", utc("2026-01-01T10:00:00Z"), utc("2026-01-02T00:00:00Z")},
+		{"local time", "0 9 * * *", ny("2026-01-01T15:00:00Z"), ny("2026-01-02T14:00:00Z")},
+
+		// clocks go forward from 02:00 EST to 03:00 EDT on 2026-03-08
+		{"skipped time runs after the change", "30 2 * * *", ny("2026-03-08T05:00:00Z"), ny("2026-03-08T07:00:00Z")},
+		{"skipped time runs normally the next day", "30 2 * * *", ny("2026-03-08T07:00:00Z"), ny("2026-03-09T06:30:00Z")},
+		{"steps continue after the change", "*/15 * * * *", ny("2026-03-08T06:45:00Z"), ny("2026-03-08T07:00:00Z")},
+		{"steps run once after the change", "*/15 * * * *", ny("2026-03-08T07:00:00Z"), ny("2026-03-08T07:15:00Z")},
+		{"time after the gap", "30 3 * * *", ny("2026-03-08T05:00:00Z"), ny("2026-03-08T07:30:00Z")},
+
+		// clocks go back from 02:00 EDT to 01:00 EST on 2026-11-01
+		{"repeated time runs", "30 1 * * *", ny("2026-11-01T04:00:00Z"), ny("2026-11-01T05:30:00Z")},
+		{"repeated time runs once", "30 1 * * *", ny("2026-11-01T05:30:00Z"), ny("2026-11-02T06:30:00Z")},
+		{"repeated time already passed", "30 1 * * *", ny("2026-11-01T06:10:00Z"), ny("2026-11-02T06:30:00Z")},
+		{"time after the repeated hour", "0 2 * * *", ny("2026-11-01T05:30:00Z"), ny("2026-11-01T07:00:00Z")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCron(%q): %v", tt.expr, err)
+			}
+			got := s.next(tt.from)
+			if !got.Equal(tt.want) {
+				t.Errorf("next(%s) of %q = %s, want %s", tt.from, tt.expr, got, tt.want)
+			}
+			if !got.IsZero() && got.Location() != tt.from.Location() {
+				t.Errorf("next(%s) of %q is in %s, want %s", tt.from, tt.expr, got.Location(), tt.from.Location())
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package cmdproxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/Ccccraz/cogmoteGO/internal/keyring"
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	zmq "github.com/pebbe/zmq4"
+)
+
+// CURVE keys of a proxy talking to a task server which requires encryption
+type curveKeys struct {
+	server string // public key of the task server
+	public string
+	secret string
+}
+
+const z85Alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%$#"
+
+// serializes generating the client keypair on first use
+var curveMu sync.Mutex
+
+// check key is a Z85 encoded CURVE key
+func validateCurveKey(key string) error {
+	if len(key) != 40 {
+		return fmt.Errorf("key must be 40 Z85 characters, got %d", len(key))
+	}
+	for _, r := range key {
+		if !strings.ContainsRune(z85Alphabet, r) {
+			return fmt.Errorf("key is not Z85 encoded: %q", r)
+		}
+	}
+	return nil
+}
+
+// keys to talk to the task server with serverKey, the client keypair is
+// taken from the keyring and generated there on first use
+func loadCurveKeys(serverKey string) (*curveKeys, error) {
+	if serverKey == "" {
+		return nil, nil
+	}
+	if !zmq.HasCurve() {
+		return nil, fmt.Errorf("libzmq is built without CURVE support")
+	}
+
+	curveMu.Lock()
+	defer curveMu.Unlock()
+
+	public, secret, err := keyring.GetCurveKeyPair()
+	if errors.Is(err, keyring.ErrNotFound) {
+		public, secret, err = zmq.NewCurveKeypair()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate CURVE keypair: %w", err)
+		}
+		if err := keyring.SaveCurveKeyPair(public, secret); err != nil {
+			return nil, fmt.Errorf("failed to store CURVE keypair: %w", err)
+		}
+		logger.Logger.Info(
+			"generated CURVE keypair: ",
+			slog.Group(
+				logKey,
+				slog.String("public_key", public),
+			),
+		)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read CURVE keypair: %w", err)
+	}
+
+	return &curveKeys{
+		server: serverKey,
+		public: public,
+		secret: secret,
+	}, nil
+}
+
+// make s encrypt its traffic and only accept the task server, must be
+// called before connecting. A nil k leaves s in plaintext.
+func (k *curveKeys) apply(s *zmq.Socket) error {
+	if k == nil {
+		return nil
+	}
+	if err := s.ClientAuthCurve(k.server, k.public, k.secret); err != nil {
+		return fmt.Errorf("failed to enable CURVE: %w", err)
+	}
+	return nil
+}
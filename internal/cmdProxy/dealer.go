@@ -0,0 +1,472 @@
+package cmdproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	zmq "github.com/pebbe/zmq4"
+)
+
+// DealerClient talks to a ROUTER task server through a DEALER socket, so
+// many commands can be in flight at once. Every command is sent as the
+// frames
+//
+//	"", request id, command
+//
+// and the server must answer with the same frames, carrying the reply in
+// place of the command. Replies are matched to their command by the request
+// id and may arrive in any order.
+type DealerClient struct {
+	clientBase
+
+	context *zmq.Context
+	nextID  atomic.Uint64
+
+	pendingMu sync.Mutex
+	pending   map[string]chan dealerReply // waiting commands by request id
+
+	// commands waiting to be sent by the socket loop
+	outgoing chan dealerRequest
+	// asks the socket loop to recreate the socket, dropping every command
+	// it has not delivered yet
+	reset chan struct{}
+	// wakes the socket loop up when a command is queued
+	wakeMu sync.Mutex
+	wake   *zmq.Socket
+
+	stopped chan struct{} // closed when the socket loop has exited
+}
+
+type dealerRequest struct {
+	id  string
+	msg []byte
+}
+
+type dealerReply struct {
+	data []byte
+	err  error
+}
+
+// ErrRequestTimeout is returned when no reply arrived in time
+var ErrRequestTimeout = errors.New("no reply within timeout")
+
+// DEALER socket connected to the task server. Commands are only queued
+// while the connection is up, so none sit in the socket waiting for a task
+// server which is down.
+func newDealerSocket(zctx *zmq.Context, hostname string, port uint, curve *curveKeys) (*zmq.Socket, error) {
+	s, err := zctx.NewSocket(zmq.DEALER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket: %w", err)
+	}
+
+	// pending commands are dropped right away on close
+	if err := s.SetLinger(0); err != nil {
+		_ = s.Close()
+		return nil, fmt.Errorf("failed to set linger: %w", err)
+	}
+
+	if err := s.SetImmediate(true); err != nil {
+		_ = s.Close()
+		return nil, fmt.Errorf("failed to set immediate: %w", err)
+	}
+
+	if err := curve.apply(s); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+
+	if err := s.Connect(fmt.Sprintf("tcp://%s:%d", hostname, port)); err != nil {
+		_ = s.Close()
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+	return s, nil
+}
+
+func createDealer(hostname string, port uint, curve *curveKeys) (*DealerClient, error) {
+	zctx, err := zmq.NewContext()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create context: %w", err)
+	}
+
+	s, err := newDealerSocket(zctx, hostname, port, curve)
+	if err != nil {
+		_ = zctx.Term()
+		return nil, err
+	}
+
+	d := &DealerClient{
+		context:  zctx,
+		pending:  make(map[string]chan dealerReply),
+		outgoing: make(chan dealerRequest, 64),
+		reset:    make(chan struct{}, 1),
+		stopped:  make(chan struct{}),
+	}
+	d.init(hostname, port, ModeDealer, curve)
+
+	wakeAddr := fmt.Sprintf("inproc://cmdproxy-wake-%p", d)
+	wakeRecv, err := zctx.NewSocket(zmq.PAIR)
+	if err == nil {
+		err = wakeRecv.Bind(wakeAddr)
+	}
+	if err == nil {
+		d.wake, err = zctx.NewSocket(zmq.PAIR)
+	}
+	if err == nil {
+		err = d.wake.Connect(wakeAddr)
+	}
+	if err != nil {
+		if wakeRecv != nil {
+			_ = wakeRecv.Close()
+		}
+		if d.wake != nil {
+			_ = d.wake.Close()
+		}
+		_ = s.Close()
+		_ = zctx.Term()
+		return nil, fmt.Errorf("failed to create wake socket: %w", err)
+	}
+
+	go d.run(s, wakeRecv)
+
+	return d, nil
+}
+
+// socket loop, the only user of the DEALER socket
+func (d *DealerClient) run(socket *zmq.Socket, wakeRecv *zmq.Socket) {
+	defer close(d.stopped)
+	defer func() { socket.Close() }()
+	defer wakeRecv.Close()
+
+	poller := zmq.NewPoller()
+	poller.Add(socket, zmq.POLLIN)
+	poller.Add(wakeRecv, zmq.POLLIN)
+
+	for {
+		polled, err := poller.Poll(-1)
+		if err != nil {
+			if zmq.AsErrno(err) == zmq.Errno(syscall.EINTR) {
+				continue
+			}
+			logger.Logger.Error(
+				"command proxy socket loop stopped: ",
+				slog.Group(
+					logKey,
+					slog.String("hostname", d.hostname),
+					slog.String("error", err.Error()),
+				),
+			)
+			return
+		}
+
+		for _, item := range polled {
+			switch item.Socket {
+			case socket:
+				for {
+					frames, err := socket.RecvMessageBytes(zmq.DONTWAIT)
+					if err != nil {
+						break
+					}
+					d.receive(frames)
+				}
+			case wakeRecv:
+				for {
+					if _, err := wakeRecv.RecvBytes(zmq.DONTWAIT); err != nil {
+						break
+					}
+				}
+			}
+		}
+
+		select {
+		case <-d.done:
+			return
+		default:
+		}
+
+		select {
+		case <-d.reset:
+			d.pendingMu.Lock()
+			idle := len(d.pending) == 0
+			d.pendingMu.Unlock()
+			if !idle {
+				break
+			}
+
+			fresh, err := newDealerSocket(d.context, d.hostname, d.port, d.curve)
+			if err != nil {
+				logger.Logger.Error(
+					"failed to recreate command proxy socket: ",
+					slog.Group(
+						logKey,
+						slog.String("hostname", d.hostname),
+						slog.String("error", err.Error()),
+					),
+				)
+				break
+			}
+			_ = socket.Close()
+			socket = fresh
+			d.metrics.addSocketRecreation()
+
+			poller = zmq.NewPoller()
+			poller.Add(socket, zmq.POLLIN)
+			poller.Add(wakeRecv, zmq.POLLIN)
+		default:
+		}
+
+		// send every queued command
+		for sending := true; sending; {
+			select {
+			case req := <-d.outgoing:
+				if _, err := socket.SendMessageDontwait("", req.id, req.msg); err != nil {
+					d.resolve(req.id, dealerReply{err: fmt.Errorf("failed to send message: %w", err)})
+				}
+			default:
+				sending = false
+			}
+		}
+	}
+}
+
+// hand a reply to the command waiting for it
+func (d *DealerClient) receive(frames [][]byte) {
+	if len(frames) > 0 && len(frames[0]) == 0 {
+		// empty delimiter frame
+		frames = frames[1:]
+	}
+	if len(frames) != 2 {
+		logger.Logger.Warn(
+			"dropping malformed command proxy reply: ",
+			slog.Group(
+				logKey,
+				slog.String("hostname", d.hostname),
+				slog.Int("frames", len(frames)),
+			),
+		)
+		return
+	}
+
+	if !d.resolve(string(frames[0]), dealerReply{data: frames[1]}) {
+		logger.Logger.Debug(
+			"dropping reply without waiting command: ",
+			slog.Group(
+				logKey,
+				slog.String("hostname", d.hostname),
+				slog.String("request_id", string(frames[0])),
+			),
+		)
+	}
+}
+
+func (d *DealerClient) resolve(id string, reply dealerReply) bool {
+	d.pendingMu.Lock()
+	ch, exists := d.pending[id]
+	d.pendingMu.Unlock()
+	if !exists {
+		return false
+	}
+
+	select {
+	case ch <- reply:
+	default:
+		// already answered by an earlier attempt
+	}
+	return true
+}
+
+// queue a command for the socket loop
+func (d *DealerClient) enqueue(id string, msg []byte) error {
+	select {
+	case d.outgoing <- dealerRequest{id: id, msg: msg}:
+	case <-d.done:
+		return ErrClientClosed
+	}
+	return d.wakeUp()
+}
+
+// drop the commands the socket still holds, so a command given up on is
+// never delivered once the task server is back. The socket is only
+// recreated while no other command waits for its reply, late replies to
+// commands given up on are dropped anyway.
+func (d *DealerClient) resetSocket() {
+	select {
+	case d.reset <- struct{}{}:
+	default:
+		// a reset is already pending
+	}
+	_ = d.wakeUp()
+}
+
+func (d *DealerClient) wakeUp() error {
+	d.wakeMu.Lock()
+	defer d.wakeMu.Unlock()
+
+	if d.wake == nil {
+		return ErrClientClosed
+	}
+	// a full pipe already holds a wake up
+	_, _ = d.wake.Send("", zmq.DONTWAIT)
+	return nil
+}
+
+// send msg and wait up to timeout for its reply, resending it with the same
+// request id up to attempts times
+func (d *DealerClient) request(msg []byte, timeout time.Duration, attempts int, retryInterval time.Duration) ([]byte, error) {
+	id := strconv.FormatUint(d.nextID.Add(1), 10)
+	replyCh := make(chan dealerReply, 1)
+
+	d.pendingMu.Lock()
+	d.pending[id] = replyCh
+	d.pendingMu.Unlock()
+
+	defer func() {
+		d.pendingMu.Lock()
+		delete(d.pending, id)
+		d.pendingMu.Unlock()
+	}()
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			d.metrics.addRetry()
+			select {
+			case <-time.After(retryInterval):
+			case <-d.done:
+				return nil, ErrClientClosed
+			}
+		}
+
+		if err := d.enqueue(id, msg); err != nil {
+			return nil, err
+		}
+
+		timer := time.NewTimer(timeout)
+		select {
+		case reply := <-replyCh:
+			timer.Stop()
+			if reply.err == nil {
+				return reply.data, nil
+			}
+			lastErr = reply.err
+			if !isRecoverableZmqError(reply.err) {
+				return nil, lastErr
+			}
+		case <-timer.C:
+			lastErr = fmt.Errorf("%w: %s", ErrRequestTimeout, timeout)
+		case <-d.done:
+			timer.Stop()
+			return nil, ErrClientClosed
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %v", ErrMaxRetriesExceeded, lastErr)
+}
+
+func (d *DealerClient) handShake() error {
+	if d.closed.Load() {
+		return ErrClientClosed
+	}
+
+	const (
+		expectedRequest  = "Hello"
+		expectedResponse = "World"
+	)
+
+	start := time.Now()
+
+	request := HandshakeREQ{Request: expectedRequest}
+	requestJson, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal handshake request: %w", err)
+	}
+
+	msgJson, err := d.request(requestJson, d.handshakeTimeout(), 1, 0)
+	if err != nil {
+		return fmt.Errorf("failed to receive handshake response: %w", err)
+	}
+	if len(msgJson) == 0 {
+		return fmt.Errorf("empty handshake response")
+	}
+
+	var msg HandshakeREP
+	if err := json.Unmarshal(msgJson, &msg); err != nil {
+		return fmt.Errorf("invalid handshake response: %w", err)
+	}
+
+	if msg.Response != expectedResponse {
+		return fmt.Errorf("wrong handshake response: %s", msg.Response)
+	}
+
+	elapsed := time.Since(start)
+	logger.Logger.Debug(
+		"Handshake completed",
+		slog.Group(
+			logKey,
+			slog.String("response", msg.Response),
+			slog.String("duration", elapsed.String()),
+		),
+	)
+
+	return nil
+}
+
+// Send msg and wait for its reply, other commands may be in flight at the
+// same time
+func (d *DealerClient) Send(msg []byte) ([]byte, error) {
+	return d.send(msg, d.sendOptions())
+}
+
+func (d *DealerClient) send(msg []byte, opts sendOptions) ([]byte, error) {
+	if d.closed.Load() {
+		return nil, ErrClientClosed
+	}
+	if !d.usable() {
+		return nil, ErrClientUnavailable
+	}
+
+	data, err := d.request(msg, opts.timeout, opts.maxRetries, opts.retryInterval)
+	if errors.Is(err, ErrMaxRetriesExceeded) {
+		d.resetSocket()
+	}
+	return data, err
+}
+
+func (d *DealerClient) Close() error {
+	if !d.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	close(d.done)
+
+	d.wakeMu.Lock()
+	_, _ = d.wake.Send("", zmq.DONTWAIT)
+	d.wakeMu.Unlock()
+
+	<-d.stopped
+
+	var errs []error
+
+	d.wakeMu.Lock()
+	if err := d.wake.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close wake socket: %w", err))
+	}
+	d.wake = nil
+	d.wakeMu.Unlock()
+
+	if err := d.context.Term(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to terminate context: %w", err))
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
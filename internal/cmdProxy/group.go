@@ -0,0 +1,472 @@
+package cmdproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/commonTypes"
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	"github.com/Ccccraz/cogmoteGO/internal/mainpath"
+	"github.com/gin-gonic/gin"
+)
+
+// policies of a proxy group
+const (
+	// send to every member and report each outcome
+	PolicyBestEffort = "best-effort"
+	// send nothing unless every member is available, the send fails when
+	// any member fails
+	PolicyAllOrNothing = "all-or-nothing"
+)
+
+// ProxyGroup is a named set of command proxies a command can be sent to at
+// once
+type ProxyGroup struct {
+	Name    string   `json:"name" binding:"required"`
+	Members []string `json:"members" binding:"required"`
+	// best-effort (default) or all-or-nothing
+	Policy string `json:"policy,omitempty"`
+}
+
+// GroupSend is the outcome of sending a command to a group
+type GroupSend struct {
+	Group   string                       `json:"group"`
+	Policy  string                       `json:"policy"`
+	Success bool                         `json:"success"`
+	Results map[string]GroupMemberResult `json:"results"`
+}
+
+type GroupMemberResult struct {
+	Status       int             `json:"status"`
+	Response     json.RawMessage `json:"response,omitempty"`
+	ResponseText bool            `json:"response_text,omitempty"`
+	LatencyMs    float64         `json:"latency_ms"`
+	Error        string          `json:"error,omitempty"`
+	// id of the command in the audit log
+	AuditID uint64 `json:"audit_id,omitempty"`
+}
+
+var (
+	groupsMu  sync.Mutex
+	groups    = make(map[string]*ProxyGroup)
+	groupFile string
+)
+
+func validatePolicy(policy string) error {
+	switch policy {
+	case PolicyBestEffort, PolicyAllOrNothing:
+		return nil
+	default:
+		return fmt.Errorf("unsupported policy: %s", policy)
+	}
+}
+
+func (g *ProxyGroup) validate() error {
+	if g.Policy == "" {
+		g.Policy = PolicyBestEffort
+	}
+	if err := validatePolicy(g.Policy); err != nil {
+		return err
+	}
+
+	if len(g.Members) == 0 {
+		return fmt.Errorf("group has no members")
+	}
+	seen := make(map[string]bool, len(g.Members))
+	for _, member := range g.Members {
+		if member == "" {
+			return fmt.Errorf("empty member nickname")
+		}
+		if seen[member] {
+			return fmt.Errorf("duplicate member: %s", member)
+		}
+		seen[member] = true
+	}
+	return nil
+}
+
+func initGroups() {
+	groupFile = filepath.Join(mainpath.DataPath, "cmds", "groups.json")
+
+	data, err := os.ReadFile(groupFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Logger.Error(
+				"failed to read proxy groups: ",
+				slog.Group(
+					logKey,
+					slog.String("error", err.Error()),
+				),
+			)
+		}
+		return
+	}
+
+	var stored []*ProxyGroup
+	if err := json.Unmarshal(data, &stored); err != nil {
+		logger.Logger.Error(
+			"invalid proxy groups file: ",
+			slog.Group(
+				logKey,
+				slog.String("error", err.Error()),
+			),
+		)
+		return
+	}
+
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	for _, group := range stored {
+		groups[group.Name] = group
+	}
+}
+
+// persist every group, groupsMu must be held
+func saveGroupsLocked() error {
+	if groupFile == "" {
+		// not initialized
+		return nil
+	}
+
+	stored := make([]*ProxyGroup, 0, len(groups))
+	for _, group := range groups {
+		stored = append(stored, group)
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].Name < stored[j].Name
+	})
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal proxy groups: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(groupFile), 0o755); err != nil {
+		return fmt.Errorf("failed to create proxy group store: %w", err)
+	}
+	if err := os.WriteFile(groupFile, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write proxy groups: %w", err)
+	}
+	return nil
+}
+
+// members of the group which cannot take a command right now, with the
+// reason
+func unavailableMembers(members []string) map[string]GroupMemberResult {
+	unavailable := make(map[string]GroupMemberResult)
+
+	reqClientMapMutex.RLock()
+	defer reqClientMapMutex.RUnlock()
+
+	for _, member := range members {
+		client, exist := reqClientMap[member]
+		switch {
+		case !exist:
+			unavailable[member] = GroupMemberResult{
+				Status: http.StatusNotFound,
+				Error:  fmt.Sprintf("command proxy %s not found", member),
+			}
+		case !client.base().usable():
+			unavailable[member] = GroupMemberResult{
+				Status: http.StatusServiceUnavailable,
+				Error:  fmt.Sprintf("command proxy %s is not available: state: %s", member, client.base().currentState()),
+			}
+		}
+	}
+	return unavailable
+}
+
+func GetGroups(c *gin.Context) {
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+
+	result := make([]*ProxyGroup, 0, len(groups))
+	for _, group := range groups {
+		result = append(result, group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	c.JSON(http.StatusOK, result)
+}
+
+func GetGroup(c *gin.Context) {
+	name := c.Param("group")
+
+	groupsMu.Lock()
+	group, exists := groups[name]
+	groupsMu.Unlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("proxy group %s not found", name),
+			Detail: "",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, group)
+}
+
+func bindGroup(c *gin.Context) (*ProxyGroup, bool) {
+	var group ProxyGroup
+	err := c.ShouldBindJSON(&group)
+	if err == nil {
+		err = group.validate()
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid proxy group",
+			Detail: err.Error(),
+		})
+		return nil, false
+	}
+	return &group, true
+}
+
+func CreateGroup(c *gin.Context) {
+	group, ok := bindGroup(c)
+	if !ok {
+		return
+	}
+
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+
+	if _, exists := groups[group.Name]; exists {
+		c.JSON(http.StatusConflict, commonTypes.APIError{
+			Error:  fmt.Sprintf("proxy group %s already exists", group.Name),
+			Detail: "",
+		})
+		return
+	}
+
+	groups[group.Name] = group
+	if err := saveGroupsLocked(); err != nil {
+		delete(groups, group.Name)
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  "failed to save proxy group",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, group)
+}
+
+// UpdateGroup replaces the members and policy of a group
+func UpdateGroup(c *gin.Context) {
+	name := c.Param("group")
+
+	group, ok := bindGroup(c)
+	if !ok {
+		return
+	}
+	if group.Name != name {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid proxy group",
+			Detail: fmt.Sprintf("name %s does not match %s", group.Name, name),
+		})
+		return
+	}
+
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+
+	previous, exists := groups[name]
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("proxy group %s not found", name),
+			Detail: "",
+		})
+		return
+	}
+
+	groups[name] = group
+	if err := saveGroupsLocked(); err != nil {
+		groups[name] = previous
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  "failed to save proxy group",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, group)
+}
+
+func DeleteGroup(c *gin.Context) {
+	name := c.Param("group")
+
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+
+	group, exists := groups[name]
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("proxy group %s not found", name),
+			Detail: "",
+		})
+		return
+	}
+
+	delete(groups, name)
+	if err := saveGroupsLocked(); err != nil {
+		groups[name] = group
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  "failed to save proxy groups",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// SendGroupCmd sends the request body to every member of a group at once.
+// The policy query parameter overrides the policy of the group, the limits
+// of the command can be overridden like for a single proxy. Answers 201
+// when every member succeeded, otherwise 207 for best-effort and 502 for
+// all-or-nothing, or 503 when all-or-nothing sent nothing because a member
+// is not available.
+func SendGroupCmd(c *gin.Context) {
+	name := c.Param("group")
+
+	groupsMu.Lock()
+	group, exists := groups[name]
+	var snapshot ProxyGroup
+	if exists {
+		snapshot = *group
+	}
+	groupsMu.Unlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("proxy group %s not found", name),
+			Detail: "",
+		})
+		return
+	}
+
+	policy := snapshot.Policy
+	if raw := c.Query("policy"); raw != "" {
+		if err := validatePolicy(raw); err != nil {
+			c.JSON(http.StatusBadRequest, commonTypes.APIError{
+				Error:  "invalid command options",
+				Detail: err.Error(),
+			})
+			return
+		}
+		policy = raw
+	}
+
+	// checked once here, so bad limits fail the whole send instead of every
+	// member
+	if _, err := parseSendOptions(c, sendOptions{}); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid command options",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	cmd, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "cannot get command data from request body",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	result := GroupSend{
+		Group:   name,
+		Policy:  policy,
+		Success: true,
+		Results: make(map[string]GroupMemberResult, len(snapshot.Members)),
+	}
+
+	if policy == PolicyAllOrNothing {
+		if unavailable := unavailableMembers(snapshot.Members); len(unavailable) > 0 {
+			result.Success = false
+			result.Results = unavailable
+			logger.Logger.Warn(
+				"group command not sent, members not available: ",
+				slog.Group(
+					logKey,
+					slog.String("group", name),
+					slog.Int("unavailable", len(unavailable)),
+				),
+			)
+			c.JSON(http.StatusServiceUnavailable, result)
+			return
+		}
+	}
+
+	origin := cmdOrigin{clientIP: c.ClientIP()}
+	options := func(opts sendOptions) (sendOptions, error) {
+		return parseSendOptions(c, opts)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		started = time.Now()
+	)
+	for _, member := range snapshot.Members {
+		wg.Add(1)
+		go func(member string) {
+			defer wg.Done()
+
+			entry := newAuditEntry(origin, member, cmd)
+			entry.Group = name
+			sent := dispatchCmd(entry, cmd, options)
+
+			memberResult := GroupMemberResult{
+				Status:    sent.status,
+				LatencyMs: entry.LatencyMs,
+				AuditID:   entry.ID,
+			}
+			if sent.failed() {
+				memberResult.Error = entry.Error
+			} else {
+				memberResult.Response, memberResult.ResponseText = auditBody(sent.data)
+			}
+
+			mu.Lock()
+			result.Results[member] = memberResult
+			if sent.failed() {
+				result.Success = false
+			}
+			mu.Unlock()
+		}(member)
+	}
+	wg.Wait()
+
+	logger.Logger.Debug(
+		"group command sent: ",
+		slog.Group(
+			logKey,
+			slog.String("group", name),
+			slog.Bool("success", result.Success),
+			slog.String("duration", time.Since(started).String()),
+		),
+	)
+
+	switch {
+	case result.Success:
+		c.JSON(http.StatusCreated, result)
+	case policy == PolicyAllOrNothing:
+		c.JSON(http.StatusBadGateway, result)
+	default:
+		c.JSON(http.StatusMultiStatus, result)
+	}
+}
@@ -0,0 +1,138 @@
+package cmdproxy
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+)
+
+// states of a command proxy
+const (
+	// waiting for the first handshake
+	StateConnecting = "connecting"
+	// the task server answered the latest handshake or command
+	StateAvailable = "available"
+	// a heartbeat or command failed, commands are still sent
+	StateDegraded = "degraded"
+	// heartbeats keep failing, commands are rejected until one succeeds
+	StateDown = "down"
+)
+
+func heartbeatInterval() time.Duration {
+	if cfg.Proxy.HeartbeatInterval <= 0 {
+		return 2 * time.Second
+	}
+	return time.Duration(cfg.Proxy.HeartbeatInterval) * time.Millisecond
+}
+
+func heartbeatFailures() int {
+	if cfg.Proxy.HeartbeatFailures <= 0 {
+		return 3
+	}
+	return cfg.Proxy.HeartbeatFailures
+}
+
+func (b *clientBase) currentState() string {
+	b.stateMu.Lock()
+	defer b.stateMu.Unlock()
+	return b.state
+}
+
+// whether commands can be sent to the task server
+func (b *clientBase) usable() bool {
+	state := b.currentState()
+	return !b.closed.Load() && (state == StateAvailable || state == StateDegraded)
+}
+
+func (b *clientBase) setStateLocked(state string) {
+	if b.state == state {
+		return
+	}
+
+	log := logger.Logger.Info
+	if state == StateDegraded || state == StateDown {
+		log = logger.Logger.Warn
+	}
+	log(
+		"command proxy state changed: ",
+		slog.Group(
+			logKey,
+			slog.String("nickname", b.nickname),
+			slog.String("from", b.state),
+			slog.String("to", state),
+		),
+	)
+
+	b.state = state
+}
+
+// record an answer of the task server
+func (b *clientBase) recordSuccess() {
+	b.stateMu.Lock()
+	defer b.stateMu.Unlock()
+
+	b.failures = 0
+	b.lastSeen = time.Now()
+	b.setStateLocked(StateAvailable)
+}
+
+// record a failed heartbeat or command
+func (b *clientBase) recordFailure() {
+	b.stateMu.Lock()
+	defer b.stateMu.Unlock()
+
+	b.failures++
+	switch {
+	case b.failures >= heartbeatFailures():
+		b.setStateLocked(StateDown)
+	case b.state == StateAvailable:
+		b.setStateLocked(StateDegraded)
+	}
+}
+
+// whether the task server answered within the last heartbeat interval
+func (b *clientBase) recentlySeen(now time.Time) bool {
+	b.stateMu.Lock()
+	defer b.stateMu.Unlock()
+	return b.state == StateAvailable && now.Sub(b.lastSeen) < heartbeatInterval()
+}
+
+// handshake with the task server every heartbeat interval until the client
+// is closed. Heartbeats are skipped while commands get answered, and a failed
+// handshake is retried on the next tick, so a restarted task server is picked
+// up again under the same nickname.
+func keepAlive(client cmdClient) {
+	base := client.base()
+
+	ticker := time.NewTicker(heartbeatInterval())
+	defer ticker.Stop()
+
+	for {
+		if !base.recentlySeen(time.Now()) {
+			if err := client.handShake(); err != nil {
+				if base.closed.Load() {
+					return
+				}
+				logger.Logger.Debug(
+					"heartbeat failed: ",
+					slog.Group(
+						logKey,
+						slog.String("nickname", base.nickname),
+						slog.String("error", err.Error()),
+					),
+				)
+				base.recordFailure()
+				base.metrics.addHeartbeatFailure()
+			} else {
+				base.recordSuccess()
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-base.done:
+			return
+		}
+	}
+}
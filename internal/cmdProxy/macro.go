@@ -0,0 +1,451 @@
+package cmdproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/commonTypes"
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	"github.com/Ccccraz/cogmoteGO/internal/mainpath"
+	"github.com/gin-gonic/gin"
+)
+
+// Macro is a named sequence of commands sent to command proxies in order
+type Macro struct {
+	Name        string      `json:"name" binding:"required"`
+	Description string      `json:"description,omitempty"`
+	Steps       []MacroStep `json:"steps" binding:"required"`
+}
+
+// MacroStep sends Payload to the command proxy NickName after waiting
+// DelayMs milliseconds. When Expect is set the reply must contain it: every
+// field of an expected object must be present with the expected value, any
+// other expected value must be equal to the reply.
+type MacroStep struct {
+	NickName string          `json:"nickname"`
+	Payload  json.RawMessage `json:"payload"`
+	DelayMs  int             `json:"delay_ms,omitempty"`
+	Expect   json.RawMessage `json:"expect,omitempty"`
+	// skip the remaining steps when this one fails
+	AbortOnFailure bool `json:"abort_on_failure,omitempty"`
+}
+
+// MacroRun is the outcome of running a macro
+type MacroRun struct {
+	Macro    string            `json:"macro"`
+	Started  time.Time         `json:"started"`
+	Finished time.Time         `json:"finished"`
+	Success  bool              `json:"success"`
+	Aborted  bool              `json:"aborted"`
+	Steps    []MacroStepResult `json:"steps"`
+}
+
+type MacroStepResult struct {
+	Index        int             `json:"index"`
+	NickName     string          `json:"nickname"`
+	Status       int             `json:"status,omitempty"`
+	Response     json.RawMessage `json:"response,omitempty"`
+	ResponseText bool            `json:"response_text,omitempty"`
+	LatencyMs    float64         `json:"latency_ms"`
+	Error        string          `json:"error,omitempty"`
+	// not sent because an earlier step aborted the macro
+	Skipped bool `json:"skipped,omitempty"`
+	// id of the command in the audit log
+	AuditID uint64 `json:"audit_id,omitempty"`
+}
+
+var (
+	macrosMu  sync.Mutex
+	macros    = make(map[string]*Macro)
+	macroFile string
+)
+
+func (m *Macro) validate() error {
+	if len(m.Steps) == 0 {
+		return fmt.Errorf("macro has no steps")
+	}
+	for i, step := range m.Steps {
+		if step.NickName == "" {
+			return fmt.Errorf("step %d: nickname is required", i)
+		}
+		if len(step.Payload) == 0 {
+			return fmt.Errorf("step %d: payload is required", i)
+		}
+		if step.DelayMs < 0 {
+			return fmt.Errorf("step %d: delay must not be negative", i)
+		}
+		if len(step.Expect) > 0 && !json.Valid(step.Expect) {
+			return fmt.Errorf("step %d: invalid expect", i)
+		}
+	}
+	return nil
+}
+
+func initMacros() {
+	macroFile = filepath.Join(mainpath.DataPath, "cmds", "macros.json")
+
+	data, err := os.ReadFile(macroFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Logger.Error(
+				"failed to read macros: ",
+				slog.Group(
+					logKey,
+					slog.String("error", err.Error()),
+				),
+			)
+		}
+		return
+	}
+
+	var stored []*Macro
+	if err := json.Unmarshal(data, &stored); err != nil {
+		logger.Logger.Error(
+			"invalid macros file: ",
+			slog.Group(
+				logKey,
+				slog.String("error", err.Error()),
+			),
+		)
+		return
+	}
+
+	macrosMu.Lock()
+	defer macrosMu.Unlock()
+	for _, macro := range stored {
+		macros[macro.Name] = macro
+	}
+}
+
+// persist every macro, macrosMu must be held
+func saveMacrosLocked() error {
+	if macroFile == "" {
+		// not initialized
+		return nil
+	}
+
+	stored := make([]*Macro, 0, len(macros))
+	for _, macro := range macros {
+		stored = append(stored, macro)
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].Name < stored[j].Name
+	})
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal macros: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(macroFile), 0o755); err != nil {
+		return fmt.Errorf("failed to create macro store: %w", err)
+	}
+	if err := os.WriteFile(macroFile, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write macros: %w", err)
+	}
+	return nil
+}
+
+// whether reply contains expect, see MacroStep
+func matchExpect(expect any, reply any) bool {
+	expectObject, ok := expect.(map[string]any)
+	if !ok {
+		return reflect.DeepEqual(expect, reply)
+	}
+	replyObject, ok := reply.(map[string]any)
+	if !ok {
+		return false
+	}
+	for key, value := range expectObject {
+		got, exists := replyObject[key]
+		if !exists || !matchExpect(value, got) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkExpect(expect json.RawMessage, data []byte) error {
+	if len(expect) == 0 {
+		return nil
+	}
+
+	var want, got any
+	if err := json.Unmarshal(expect, &want); err != nil {
+		return fmt.Errorf("invalid expect: %w", err)
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		return fmt.Errorf("reply is not JSON: %w", err)
+	}
+	if !matchExpect(want, got) {
+		return fmt.Errorf("unexpected reply: %s", data)
+	}
+	return nil
+}
+
+// run the steps of macro in order, stopping early when a step with
+// AbortOnFailure fails or ctx is canceled
+func runMacro(ctx context.Context, origin cmdOrigin, macro Macro) MacroRun {
+	run := MacroRun{
+		Macro:   macro.Name,
+		Started: time.Now(),
+		Success: true,
+		Steps:   make([]MacroStepResult, 0, len(macro.Steps)),
+	}
+
+	for i, step := range macro.Steps {
+		result := MacroStepResult{
+			Index:    i,
+			NickName: step.NickName,
+		}
+
+		if run.Aborted {
+			result.Skipped = true
+			run.Steps = append(run.Steps, result)
+			continue
+		}
+
+		if step.DelayMs > 0 {
+			select {
+			case <-time.After(time.Duration(step.DelayMs) * time.Millisecond):
+			case <-ctx.Done():
+				result.Error = "macro canceled"
+				run.Steps = append(run.Steps, result)
+				run.Success = false
+				run.Aborted = true
+				continue
+			}
+		}
+
+		entry := newAuditEntry(origin, step.NickName, step.Payload)
+		entry.Macro = macro.Name
+		sent := dispatchCmd(entry, step.Payload, nil)
+
+		result.Status = sent.status
+		result.LatencyMs = entry.LatencyMs
+		result.AuditID = entry.ID
+		if sent.failed() {
+			result.Error = entry.Error
+		} else {
+			result.Response, result.ResponseText = auditBody(sent.data)
+			if err := checkExpect(step.Expect, sent.data); err != nil {
+				result.Error = err.Error()
+			}
+		}
+
+		if result.Error != "" {
+			run.Success = false
+			run.Aborted = step.AbortOnFailure
+			logger.Logger.Warn(
+				"macro step failed: ",
+				slog.Group(
+					logKey,
+					slog.String("macro", macro.Name),
+					slog.Int("step", i),
+					slog.String("nickname", step.NickName),
+					slog.String("error", result.Error),
+				),
+			)
+		}
+		run.Steps = append(run.Steps, result)
+	}
+
+	run.Finished = time.Now()
+	return run
+}
+
+// copy of the macro name, safe to run without holding macrosMu
+func macroSnapshot(name string) (Macro, bool) {
+	macrosMu.Lock()
+	defer macrosMu.Unlock()
+
+	macro, exists := macros[name]
+	if !exists {
+		return Macro{}, false
+	}
+	return *macro, true
+}
+
+func GetMacros(c *gin.Context) {
+	macrosMu.Lock()
+	defer macrosMu.Unlock()
+
+	result := make([]*Macro, 0, len(macros))
+	for _, macro := range macros {
+		result = append(result, macro)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	c.JSON(http.StatusOK, result)
+}
+
+func GetMacro(c *gin.Context) {
+	name := c.Param("macro")
+
+	macrosMu.Lock()
+	macro, exists := macros[name]
+	macrosMu.Unlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("macro %s not found", name),
+			Detail: "",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, macro)
+}
+
+func bindMacro(c *gin.Context) (*Macro, bool) {
+	var macro Macro
+	err := c.ShouldBindJSON(&macro)
+	if err == nil {
+		err = macro.validate()
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid macro",
+			Detail: err.Error(),
+		})
+		return nil, false
+	}
+	return &macro, true
+}
+
+func CreateMacro(c *gin.Context) {
+	macro, ok := bindMacro(c)
+	if !ok {
+		return
+	}
+
+	macrosMu.Lock()
+	defer macrosMu.Unlock()
+
+	if _, exists := macros[macro.Name]; exists {
+		c.JSON(http.StatusConflict, commonTypes.APIError{
+			Error:  fmt.Sprintf("macro %s already exists", macro.Name),
+			Detail: "",
+		})
+		return
+	}
+
+	macros[macro.Name] = macro
+	if err := saveMacrosLocked(); err != nil {
+		delete(macros, macro.Name)
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  "failed to save macro",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, macro)
+}
+
+// UpdateMacro replaces the steps and description of a macro
+func UpdateMacro(c *gin.Context) {
+	name := c.Param("macro")
+
+	macro, ok := bindMacro(c)
+	if !ok {
+		return
+	}
+	if macro.Name != name {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid macro",
+			Detail: fmt.Sprintf("name %s does not match %s", macro.Name, name),
+		})
+		return
+	}
+
+	macrosMu.Lock()
+	defer macrosMu.Unlock()
+
+	previous, exists := macros[name]
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("macro %s not found", name),
+			Detail: "",
+		})
+		return
+	}
+
+	macros[name] = macro
+	if err := saveMacrosLocked(); err != nil {
+		macros[name] = previous
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  "failed to save macro",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, macro)
+}
+
+func DeleteMacro(c *gin.Context) {
+	name := c.Param("macro")
+
+	macrosMu.Lock()
+	defer macrosMu.Unlock()
+
+	macro, exists := macros[name]
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("macro %s not found", name),
+			Detail: "",
+		})
+		return
+	}
+
+	delete(macros, name)
+	if err := saveMacrosLocked(); err != nil {
+		macros[name] = macro
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  "failed to save macros",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// RunMacro sends the steps of a macro and answers with the result of each
+// step once the macro is done
+func RunMacro(c *gin.Context) {
+	name := c.Param("macro")
+
+	snapshot, exists := macroSnapshot(name)
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("macro %s not found", name),
+			Detail: "",
+		})
+		return
+	}
+
+	logger.Logger.Info(
+		"running macro: ",
+		slog.Group(
+			logKey,
+			slog.String("macro", name),
+			slog.Int("steps", len(snapshot.Steps)),
+		),
+	)
+
+	origin := cmdOrigin{clientIP: c.ClientIP()}
+	c.JSON(http.StatusOK, runMacro(c.Request.Context(), origin, snapshot))
+}
@@ -0,0 +1,313 @@
+package cmdproxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/commonTypes"
+	"github.com/gin-gonic/gin"
+)
+
+// outcomes of a command
+const (
+	resultSuccess = "success"
+	// no reply after every retry
+	resultTimeout = "timeout"
+	// the command failed for another reason
+	resultError = "error"
+	// not sent because the proxy is not available
+	resultUnavailable = "unavailable"
+)
+
+// upper bounds of the latency histogram buckets in milliseconds
+var latencyBuckets = []float64{0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// counters of a command proxy since it was created
+type proxyMetrics struct {
+	mu sync.Mutex
+
+	results           map[string]uint64
+	retries           uint64
+	socketRecreations uint64
+	heartbeatFailures uint64
+
+	// round-trip latency of the answered commands, the last bucket counts
+	// the ones above the last bound
+	latencyCounts []uint64
+	latencySum    time.Duration
+	latencyCount  uint64
+}
+
+// ProxyStats is a snapshot of the metrics of a command proxy
+type ProxyStats struct {
+	NickName          string       `json:"nickname"`
+	State             string       `json:"state"`
+	Commands          uint64       `json:"commands"`
+	Successes         uint64       `json:"successes"`
+	Timeouts          uint64       `json:"timeouts"`
+	Errors            uint64       `json:"errors"`
+	Unavailable       uint64       `json:"unavailable"`
+	Retries           uint64       `json:"retries"`
+	SocketRecreations uint64       `json:"socket_recreations"`
+	HeartbeatFailures uint64       `json:"heartbeat_failures"`
+	Latency           LatencyStats `json:"latency"`
+}
+
+// LatencyStats summarizes the round-trip latency of the answered commands,
+// percentiles are estimated from the histogram
+type LatencyStats struct {
+	Count   uint64          `json:"count"`
+	SumMs   float64         `json:"sum_ms"`
+	MeanMs  float64         `json:"mean_ms"`
+	P50Ms   float64         `json:"p50_ms"`
+	P90Ms   float64         `json:"p90_ms"`
+	P99Ms   float64         `json:"p99_ms"`
+	Buckets []LatencyBucket `json:"buckets"`
+}
+
+// LatencyBucket counts the commands answered within LeMs milliseconds,
+// cumulative like in Prometheus. The last bucket has no bound.
+type LatencyBucket struct {
+	LeMs  float64 `json:"le_ms,omitempty"`
+	Count uint64  `json:"count"`
+}
+
+func (m *proxyMetrics) initLocked() {
+	if m.results == nil {
+		m.results = make(map[string]uint64)
+		m.latencyCounts = make([]uint64, len(latencyBuckets)+1)
+	}
+}
+
+// record the outcome of a command, latency is only kept for answered ones
+func (m *proxyMetrics) observe(result string, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.initLocked()
+	m.results[result]++
+	if result != resultSuccess {
+		return
+	}
+
+	ms := float64(latency) / float64(time.Millisecond)
+	bucket := sort.SearchFloat64s(latencyBuckets, ms)
+	m.latencyCounts[bucket]++
+	m.latencySum += latency
+	m.latencyCount++
+}
+
+func (m *proxyMetrics) addRetry() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retries++
+}
+
+func (m *proxyMetrics) addSocketRecreation() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.socketRecreations++
+}
+
+func (m *proxyMetrics) addHeartbeatFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.heartbeatFailures++
+}
+
+// estimate the q quantile of the latency by interpolating within the
+// bucket it falls in, in milliseconds. m.mu must be held.
+func (m *proxyMetrics) quantileLocked(q float64) float64 {
+	if m.latencyCount == 0 {
+		return 0
+	}
+
+	rank := q * float64(m.latencyCount)
+	var seen uint64
+	for i, count := range m.latencyCounts {
+		if count == 0 || float64(seen+count) < rank {
+			seen += count
+			continue
+		}
+		if i == len(latencyBuckets) {
+			// above the last bound
+			return latencyBuckets[len(latencyBuckets)-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+		upper := latencyBuckets[i]
+		return lower + (upper-lower)*(rank-float64(seen))/float64(count)
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
+
+func (b *clientBase) stats() ProxyStats {
+	m := &b.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.initLocked()
+
+	stats := ProxyStats{
+		NickName:          b.nickname,
+		State:             b.currentState(),
+		Successes:         m.results[resultSuccess],
+		Timeouts:          m.results[resultTimeout],
+		Errors:            m.results[resultError],
+		Unavailable:       m.results[resultUnavailable],
+		Retries:           m.retries,
+		SocketRecreations: m.socketRecreations,
+		HeartbeatFailures: m.heartbeatFailures,
+		Latency: LatencyStats{
+			Count:   m.latencyCount,
+			SumMs:   float64(m.latencySum) / float64(time.Millisecond),
+			P50Ms:   m.quantileLocked(0.5),
+			P90Ms:   m.quantileLocked(0.9),
+			P99Ms:   m.quantileLocked(0.99),
+			Buckets: make([]LatencyBucket, 0, len(m.latencyCounts)),
+		},
+	}
+	stats.Commands = stats.Successes + stats.Timeouts + stats.Errors + stats.Unavailable
+	if m.latencyCount > 0 {
+		stats.Latency.MeanMs = stats.Latency.SumMs / float64(m.latencyCount)
+	}
+
+	var cumulative uint64
+	for i, count := range m.latencyCounts {
+		cumulative += count
+		bucket := LatencyBucket{Count: cumulative}
+		if i < len(latencyBuckets) {
+			bucket.LeMs = latencyBuckets[i]
+		}
+		stats.Latency.Buckets = append(stats.Latency.Buckets, bucket)
+	}
+
+	return stats
+}
+
+// stats of every command proxy sorted by nickname
+func allStats() []ProxyStats {
+	reqClientMapMutex.RLock()
+	clients := make([]cmdClient, 0, len(reqClientMap))
+	for _, client := range reqClientMap {
+		clients = append(clients, client)
+	}
+	reqClientMapMutex.RUnlock()
+
+	stats := make([]ProxyStats, 0, len(clients))
+	for _, client := range clients {
+		stats = append(stats, client.base().stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].NickName < stats[j].NickName
+	})
+	return stats
+}
+
+func GetAllCmdProxyStats(c *gin.Context) {
+	c.JSON(http.StatusOK, allStats())
+}
+
+func GetCmdProxyStats(c *gin.Context) {
+	nickname := c.Param("nickname")
+
+	reqClientMapMutex.RLock()
+	client, exist := reqClientMap[nickname]
+	reqClientMapMutex.RUnlock()
+
+	if !exist {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("command proxy %s not found", nickname),
+			Detail: "",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, client.base().stats())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// GetCmdProxyMetrics exposes the metrics of every command proxy in the
+// Prometheus text format
+func GetCmdProxyMetrics(c *gin.Context) {
+	stats := allStats()
+
+	var b strings.Builder
+	family := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	family("cogmote_cmdproxy_up", "gauge", "Whether the command proxy accepts commands.")
+	for _, s := range stats {
+		up := 0
+		if s.State == StateAvailable || s.State == StateDegraded {
+			up = 1
+		}
+		fmt.Fprintf(&b, "cogmote_cmdproxy_up{nickname=\"%s\",state=\"%s\"} %d\n",
+			labelEscaper.Replace(s.NickName), s.State, up)
+	}
+
+	family("cogmote_cmdproxy_commands_total", "counter", "Commands sent through the command proxy by result.")
+	for _, s := range stats {
+		nickname := labelEscaper.Replace(s.NickName)
+		for _, result := range []struct {
+			name  string
+			count uint64
+		}{
+			{resultSuccess, s.Successes},
+			{resultTimeout, s.Timeouts},
+			{resultError, s.Errors},
+			{resultUnavailable, s.Unavailable},
+		} {
+			fmt.Fprintf(&b, "cogmote_cmdproxy_commands_total{nickname=\"%s\",result=\"%s\"} %d\n",
+				nickname, result.name, result.count)
+		}
+	}
+
+	counters := []struct {
+		name  string
+		help  string
+		value func(ProxyStats) uint64
+	}{
+		{"cogmote_cmdproxy_retries_total", "Commands resent after a missing reply.", func(s ProxyStats) uint64 { return s.Retries }},
+		{"cogmote_cmdproxy_socket_recreations_total", "REQ sockets discarded and recreated.", func(s ProxyStats) uint64 { return s.SocketRecreations }},
+		{"cogmote_cmdproxy_heartbeat_failures_total", "Failed heartbeats.", func(s ProxyStats) uint64 { return s.HeartbeatFailures }},
+	}
+	for _, counter := range counters {
+		family(counter.name, "counter", counter.help)
+		for _, s := range stats {
+			fmt.Fprintf(&b, "%s{nickname=\"%s\"} %d\n", counter.name, labelEscaper.Replace(s.NickName), counter.value(s))
+		}
+	}
+
+	family("cogmote_cmdproxy_latency_seconds", "histogram", "Round-trip latency of answered commands.")
+	for _, s := range stats {
+		nickname := labelEscaper.Replace(s.NickName)
+		for _, bucket := range s.Latency.Buckets {
+			le := math.Inf(1)
+			if bucket.LeMs > 0 {
+				le = bucket.LeMs / 1000
+			}
+			fmt.Fprintf(&b, "cogmote_cmdproxy_latency_seconds_bucket{nickname=\"%s\",le=\"%s\"} %d\n",
+				nickname, formatFloat(le), bucket.Count)
+		}
+		fmt.Fprintf(&b, "cogmote_cmdproxy_latency_seconds_sum{nickname=\"%s\"} %s\n", nickname, formatFloat(s.Latency.SumMs/1000))
+		fmt.Fprintf(&b, "cogmote_cmdproxy_latency_seconds_count{nickname=\"%s\"} %d\n", nickname, s.Latency.Count)
+	}
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
@@ -0,0 +1,104 @@
+package cmdproxy
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Timeouts overrides the proxy config for a single proxy, zero values use
+// the config. Timeouts and intervals are in milliseconds.
+type Timeouts struct {
+	HandshakeTimeout int `json:"handshake_timeout,omitempty"`
+	MsgTimeout       int `json:"msg_timeout,omitempty"`
+	MaxRetries       int `json:"max_retries,omitempty"`
+	RetryInterval    int `json:"retry_interval,omitempty"`
+}
+
+func (t Timeouts) validate() error {
+	if t.HandshakeTimeout < 0 || t.MsgTimeout < 0 || t.MaxRetries < 0 || t.RetryInterval < 0 {
+		return fmt.Errorf("timeouts and retries must not be negative")
+	}
+	return nil
+}
+
+// limits of a single command
+type sendOptions struct {
+	timeout       time.Duration
+	maxRetries    int
+	retryInterval time.Duration
+}
+
+func (b *clientBase) handshakeTimeout() time.Duration {
+	if b.timeouts.HandshakeTimeout > 0 {
+		return time.Duration(b.timeouts.HandshakeTimeout) * time.Millisecond
+	}
+	return time.Duration(cfg.Proxy.HandshakeTimeout) * time.Millisecond
+}
+
+// limits of a command without per-request overrides
+func (b *clientBase) sendOptions() sendOptions {
+	opts := sendOptions{
+		timeout:       time.Duration(cfg.Proxy.MsgTimeout) * time.Millisecond,
+		maxRetries:    lazyPirateMaxRetries(),
+		retryInterval: lazyPirateRetryInterval(),
+	}
+	if b.timeouts.MsgTimeout > 0 {
+		opts.timeout = time.Duration(b.timeouts.MsgTimeout) * time.Millisecond
+	}
+	if b.timeouts.MaxRetries > 0 {
+		opts.maxRetries = b.timeouts.MaxRetries
+	}
+	if b.timeouts.RetryInterval > 0 {
+		opts.retryInterval = time.Duration(b.timeouts.RetryInterval) * time.Millisecond
+	}
+	return opts
+}
+
+// override the limits of a command with the timeout, max_retries and
+// retry_interval query parameters, or the X-Timeout, X-Max-Retries and
+// X-Retry-Interval headers. Values must be positive.
+func parseSendOptions(c *gin.Context, opts sendOptions) (sendOptions, error) {
+	value := func(query string, header string) (int, bool, error) {
+		raw := c.Query(query)
+		if raw == "" {
+			raw = c.GetHeader(header)
+		}
+		if raw == "" {
+			return 0, false, nil
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return 0, false, fmt.Errorf("invalid %s: %s, must be a positive integer", query, raw)
+		}
+		return n, true, nil
+	}
+
+	timeout, ok, err := value("timeout", "X-Timeout")
+	if err != nil {
+		return opts, err
+	}
+	if ok {
+		opts.timeout = time.Duration(timeout) * time.Millisecond
+	}
+
+	maxRetries, ok, err := value("max_retries", "X-Max-Retries")
+	if err != nil {
+		return opts, err
+	}
+	if ok {
+		opts.maxRetries = maxRetries
+	}
+
+	retryInterval, ok, err := value("retry_interval", "X-Retry-Interval")
+	if err != nil {
+		return opts, err
+	}
+	if ok {
+		opts.retryInterval = time.Duration(retryInterval) * time.Millisecond
+	}
+
+	return opts, nil
+}
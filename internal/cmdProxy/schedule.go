@@ -0,0 +1,561 @@
+package cmdproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/commonTypes"
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	"github.com/Ccccraz/cogmoteGO/internal/mainpath"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ScheduledJob sends Payload to the command proxy NickName, or runs Macro,
+// once at At or on every time matching Cron. A job created with DelayMs
+// runs once that many milliseconds after its creation. Cron expressions use
+// the local time of the service.
+type ScheduledJob struct {
+	ID          string          `json:"id"`
+	Description string          `json:"description,omitempty"`
+	NickName    string          `json:"nickname,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Macro       string          `json:"macro,omitempty"`
+	At          *time.Time      `json:"at,omitempty"`
+	DelayMs     int64           `json:"delay_ms,omitempty"`
+	Cron        string          `json:"cron,omitempty"`
+	Created     time.Time       `json:"created"`
+	NextRun     time.Time       `json:"next_run"`
+	LastRun     *time.Time      `json:"last_run,omitempty"`
+	Runs        int             `json:"runs"`
+}
+
+// JobRun is one execution of a scheduled job
+type JobRun struct {
+	Job          string          `json:"job"`
+	Time         time.Time       `json:"time"`
+	NickName     string          `json:"nickname,omitempty"`
+	Macro        string          `json:"macro,omitempty"`
+	Success      bool            `json:"success"`
+	Status       int             `json:"status,omitempty"`
+	Response     json.RawMessage `json:"response,omitempty"`
+	ResponseText bool            `json:"response_text,omitempty"`
+	LatencyMs    float64         `json:"latency_ms,omitempty"`
+	Error        string          `json:"error,omitempty"`
+	// id of the command in the audit log
+	AuditID  uint64    `json:"audit_id,omitempty"`
+	MacroRun *MacroRun `json:"macro_run,omitempty"`
+}
+
+type scheduledJob struct {
+	job   ScheduledJob
+	cron  *cronSchedule
+	timer *time.Timer
+}
+
+var (
+	schedulesMu  sync.Mutex
+	schedules    = make(map[string]*scheduledJob)
+	scheduleFile string
+	// append-only log of every job run, one JSON entry per line
+	scheduleHistoryFile string
+	scheduleHistoryMu   sync.Mutex
+)
+
+// check the job and compute its first run
+func (j *ScheduledJob) prepare(now time.Time) (*cronSchedule, error) {
+	hasCmd := j.NickName != "" || len(j.Payload) > 0
+	switch {
+	case hasCmd && j.Macro != "":
+		return nil, fmt.Errorf("a job sends either a command or a macro")
+	case j.Macro == "" && (j.NickName == "" || len(j.Payload) == 0):
+		return nil, fmt.Errorf("nickname and payload are required")
+	}
+
+	kinds := 0
+	if j.At != nil {
+		kinds++
+	}
+	if j.DelayMs != 0 {
+		kinds++
+	}
+	if j.Cron != "" {
+		kinds++
+	}
+	if kinds != 1 {
+		return nil, fmt.Errorf("exactly one of at, delay_ms and cron is required")
+	}
+
+	switch {
+	case j.DelayMs < 0:
+		return nil, fmt.Errorf("delay must not be negative")
+	case j.DelayMs > 0:
+		at := now.Add(time.Duration(j.DelayMs) * time.Millisecond)
+		j.At = &at
+		j.DelayMs = 0
+		j.NextRun = at
+	case j.At != nil:
+		if !j.At.After(now) {
+			return nil, fmt.Errorf("at %s is in the past", j.At.Format(time.RFC3339))
+		}
+		j.NextRun = *j.At
+	default:
+		schedule, err := parseCron(j.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron: %w", err)
+		}
+		j.NextRun = schedule.next(now.Local())
+		if j.NextRun.IsZero() {
+			return nil, fmt.Errorf("cron %s never matches", j.Cron)
+		}
+		return schedule, nil
+	}
+	return nil, nil
+}
+
+func initSchedules() {
+	scheduleFile = filepath.Join(mainpath.DataPath, "cmds", "schedules.json")
+	scheduleHistoryFile = filepath.Join(mainpath.DataPath, "cmds", "schedule_history.jsonl")
+
+	data, err := os.ReadFile(scheduleFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Logger.Error(
+				"failed to read scheduled jobs: ",
+				slog.Group(
+					logKey,
+					slog.String("error", err.Error()),
+				),
+			)
+		}
+		return
+	}
+
+	var stored []ScheduledJob
+	if err := json.Unmarshal(data, &stored); err != nil {
+		logger.Logger.Error(
+			"invalid scheduled jobs file: ",
+			slog.Group(
+				logKey,
+				slog.String("error", err.Error()),
+			),
+		)
+		return
+	}
+
+	now := time.Now()
+
+	schedulesMu.Lock()
+	defer schedulesMu.Unlock()
+
+	for _, job := range stored {
+		s := &scheduledJob{job: job}
+
+		if job.Cron != "" {
+			schedule, err := parseCron(job.Cron)
+			if err != nil {
+				logger.Logger.Error(
+					"skipping invalid scheduled job: ",
+					slog.Group(
+						logKey,
+						slog.String("id", job.ID),
+						slog.String("error", err.Error()),
+					),
+				)
+				continue
+			}
+			s.cron = schedule
+			s.job.NextRun = schedule.next(now.Local())
+		} else if job.NextRun.Before(now) {
+			// a command meant for a moment which has passed could do harm,
+			// it is dropped instead of sent late
+			recordJobRun(JobRun{
+				Job:      job.ID,
+				Time:     now,
+				NickName: job.NickName,
+				Macro:    job.Macro,
+				Error:    fmt.Sprintf("missed at %s while the service was down", job.NextRun.Format(time.RFC3339)),
+			})
+			logger.Logger.Warn(
+				"scheduled job missed: ",
+				slog.Group(
+					logKey,
+					slog.String("id", job.ID),
+					slog.Time("at", job.NextRun),
+				),
+			)
+			continue
+		}
+
+		schedules[job.ID] = s
+		s.armLocked(now)
+	}
+
+	if err := saveSchedulesLocked(); err != nil {
+		logger.Logger.Error(
+			"failed to save scheduled jobs: ",
+			slog.Group(
+				logKey,
+				slog.String("error", err.Error()),
+			),
+		)
+	}
+}
+
+// persist every scheduled job, schedulesMu must be held
+func saveSchedulesLocked() error {
+	if scheduleFile == "" {
+		// not initialized
+		return nil
+	}
+
+	stored := make([]ScheduledJob, 0, len(schedules))
+	for _, s := range schedules {
+		stored = append(stored, s.job)
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].Created.Before(stored[j].Created)
+	})
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal scheduled jobs: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(scheduleFile), 0o755); err != nil {
+		return fmt.Errorf("failed to create schedule store: %w", err)
+	}
+	if err := os.WriteFile(scheduleFile, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write scheduled jobs: %w", err)
+	}
+	return nil
+}
+
+// start the timer of the next run, schedulesMu must be held
+func (s *scheduledJob) armLocked(now time.Time) {
+	id := s.job.ID
+	s.timer = time.AfterFunc(s.job.NextRun.Sub(now), func() {
+		runScheduledJob(id)
+	})
+}
+
+func runScheduledJob(id string) {
+	schedulesMu.Lock()
+	s, exists := schedules[id]
+	var job ScheduledJob
+	if exists {
+		job = s.job
+	}
+	schedulesMu.Unlock()
+
+	if !exists {
+		// canceled
+		return
+	}
+
+	logger.Logger.Info(
+		"running scheduled job: ",
+		slog.Group(
+			logKey,
+			slog.String("id", id),
+			slog.String("nickname", job.NickName),
+			slog.String("macro", job.Macro),
+		),
+	)
+
+	run := executeJob(job)
+	recordJobRun(run)
+
+	schedulesMu.Lock()
+	defer schedulesMu.Unlock()
+
+	if schedules[id] != s {
+		// canceled while running
+		return
+	}
+
+	now := time.Now()
+	s.job.Runs++
+	s.job.LastRun = &run.Time
+
+	if s.cron == nil {
+		delete(schedules, id)
+	} else {
+		s.job.NextRun = s.cron.next(now.Local())
+		if s.job.NextRun.IsZero() {
+			delete(schedules, id)
+		} else {
+			s.armLocked(now)
+		}
+	}
+
+	if err := saveSchedulesLocked(); err != nil {
+		logger.Logger.Error(
+			"failed to save scheduled jobs: ",
+			slog.Group(
+				logKey,
+				slog.String("error", err.Error()),
+			),
+		)
+	}
+}
+
+func executeJob(job ScheduledJob) JobRun {
+	run := JobRun{
+		Job:      job.ID,
+		Time:     time.Now(),
+		NickName: job.NickName,
+		Macro:    job.Macro,
+	}
+	origin := cmdOrigin{schedule: job.ID}
+
+	if job.Macro != "" {
+		macro, exists := macroSnapshot(job.Macro)
+		if !exists {
+			run.Error = fmt.Sprintf("macro %s not found", job.Macro)
+			return run
+		}
+		macroRun := runMacro(context.Background(), origin, macro)
+		run.MacroRun = &macroRun
+		run.Success = macroRun.Success
+		if !macroRun.Success {
+			run.Error = "macro failed"
+		}
+		return run
+	}
+
+	entry := newAuditEntry(origin, job.NickName, job.Payload)
+	result := dispatchCmd(entry, job.Payload, nil)
+
+	run.Status = result.status
+	run.LatencyMs = entry.LatencyMs
+	run.AuditID = entry.ID
+	run.Success = !result.failed()
+	if result.failed() {
+		run.Error = entry.Error
+	} else {
+		run.Response, run.ResponseText = auditBody(result.data)
+	}
+	return run
+}
+
+func recordJobRun(run JobRun) {
+	if scheduleHistoryFile == "" {
+		// not initialized
+		return
+	}
+
+	scheduleHistoryMu.Lock()
+	err := appendJSONLine(scheduleHistoryFile, run)
+	scheduleHistoryMu.Unlock()
+
+	if err != nil {
+		logger.Logger.Error(
+			"failed to record scheduled job run: ",
+			slog.Group(
+				logKey,
+				slog.String("id", run.Job),
+				slog.String("error", err.Error()),
+			),
+		)
+	}
+}
+
+func GetSchedules(c *gin.Context) {
+	schedulesMu.Lock()
+	defer schedulesMu.Unlock()
+
+	result := make([]ScheduledJob, 0, len(schedules))
+	for _, s := range schedules {
+		result = append(result, s.job)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].NextRun.Before(result[j].NextRun)
+	})
+
+	c.JSON(http.StatusOK, result)
+}
+
+func GetSchedule(c *gin.Context) {
+	id := c.Param("id")
+
+	schedulesMu.Lock()
+	s, exists := schedules[id]
+	var job ScheduledJob
+	if exists {
+		job = s.job
+	}
+	schedulesMu.Unlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("scheduled job %s not found", id),
+			Detail: "",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+func CreateSchedule(c *gin.Context) {
+	var job ScheduledJob
+	if err := c.ShouldBindJSON(&job); err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid scheduled job",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	now := time.Now()
+	job.ID = uuid.New().String()
+	job.Created = now
+	job.LastRun = nil
+	job.Runs = 0
+
+	schedule, err := job.prepare(now)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid scheduled job",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	// the target may still go away later, the run then records the error
+	if job.Macro != "" {
+		if _, exists := macroSnapshot(job.Macro); !exists {
+			c.JSON(http.StatusNotFound, commonTypes.APIError{
+				Error:  fmt.Sprintf("macro %s not found", job.Macro),
+				Detail: "",
+			})
+			return
+		}
+	} else {
+		reqClientMapMutex.RLock()
+		_, exist := reqClientMap[job.NickName]
+		reqClientMapMutex.RUnlock()
+
+		if !exist {
+			c.JSON(http.StatusNotFound, commonTypes.APIError{
+				Error:  fmt.Sprintf("command proxy %s not found", job.NickName),
+				Detail: "",
+			})
+			return
+		}
+	}
+
+	schedulesMu.Lock()
+	defer schedulesMu.Unlock()
+
+	s := &scheduledJob{job: job, cron: schedule}
+	schedules[job.ID] = s
+	if err := saveSchedulesLocked(); err != nil {
+		delete(schedules, job.ID)
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  "failed to save scheduled job",
+			Detail: err.Error(),
+		})
+		return
+	}
+	s.armLocked(now)
+
+	logger.Logger.Info(
+		"scheduled job created: ",
+		slog.Group(
+			logKey,
+			slog.String("id", job.ID),
+			slog.Time("next_run", job.NextRun),
+		),
+	)
+
+	c.JSON(http.StatusCreated, job)
+}
+
+// CancelSchedule removes a scheduled job, a run in progress is completed
+func CancelSchedule(c *gin.Context) {
+	id := c.Param("id")
+
+	schedulesMu.Lock()
+	defer schedulesMu.Unlock()
+
+	s, exists := schedules[id]
+	if !exists {
+		c.JSON(http.StatusNotFound, commonTypes.APIError{
+			Error:  fmt.Sprintf("scheduled job %s not found", id),
+			Detail: "",
+		})
+		return
+	}
+
+	delete(schedules, id)
+	if err := saveSchedulesLocked(); err != nil {
+		schedules[id] = s
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  "failed to save scheduled jobs",
+			Detail: err.Error(),
+		})
+		return
+	}
+	s.timer.Stop()
+
+	logger.Logger.Info(
+		"scheduled job canceled: ",
+		slog.Group(
+			logKey,
+			slog.String("id", id),
+		),
+	)
+
+	c.Status(http.StatusOK)
+}
+
+// GetScheduleHistory lists the latest job runs, oldest first. The job query
+// parameter, or the :id path parameter, selects the runs of one job, the
+// nickname, from, to and limit parameters work like for the command history.
+func GetScheduleHistory(c *gin.Context) {
+	query, err := parseHistoryQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, commonTypes.APIError{
+			Error:  "invalid history query",
+			Detail: err.Error(),
+		})
+		return
+	}
+	job := c.Param("id")
+	if job == "" {
+		job = c.Query("job")
+	}
+
+	runs := make([]JobRun, 0)
+	err = scanJSONLines(scheduleHistoryFile, func(run JobRun) bool {
+		if job != "" && run.Job != job {
+			return true
+		}
+		if query.matchAt(run.NickName, run.Time) {
+			runs = append(runs, run)
+			if len(runs) > query.limit {
+				runs = runs[1:]
+			}
+		}
+		return true
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  "failed to read schedule history",
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, runs)
+}
@@ -0,0 +1,184 @@
+package cmdproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Ccccraz/cogmoteGO/internal/config"
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	"github.com/Ccccraz/cogmoteGO/internal/mainpath"
+)
+
+// file the command proxies created through the API are persisted to
+var storeFile string
+
+// Restore the command proxies declared in the config file and the ones
+// persisted by an earlier run, each is handshaken in the background. Also
+// opens the command audit log, loads the macros and proxy groups and arms
+// the scheduled jobs.
+func Init(config config.Config) {
+	cfg = config
+	storeFile = filepath.Join(mainpath.DataPath, "cmds", "proxies.json")
+
+	logger.Logger.Debug(
+		"location of command proxy store: ",
+		slog.Group(
+			logKey,
+			slog.String("location", storeFile),
+		),
+	)
+
+	initAudit()
+	initMacros()
+	initGroups()
+	initSchedules()
+
+	for _, static := range cfg.Proxy.Static {
+		restoreProxy(Endpoint{
+			NickName:  static.NickName,
+			Hostname:  static.Hostname,
+			Port:      static.Port,
+			Mode:      static.Mode,
+			Static:    true,
+			ServerKey: static.ServerKey,
+			Timeouts: Timeouts{
+				HandshakeTimeout: static.HandshakeTimeout,
+				MsgTimeout:       static.MsgTimeout,
+				MaxRetries:       static.MaxRetries,
+				RetryInterval:    static.RetryInterval,
+			},
+		})
+	}
+
+	for _, endpoint := range loadProxies() {
+		endpoint.Static = false
+		restoreProxy(endpoint)
+	}
+}
+
+func restoreProxy(endpoint Endpoint) {
+	if endpoint.NickName == "" || endpoint.Hostname == "" || endpoint.Port == 0 {
+		logger.Logger.Error(
+			"skipping incomplete command proxy: ",
+			slog.Group(
+				logKey,
+				slog.String("nickname", endpoint.NickName),
+			),
+		)
+		return
+	}
+
+	err := endpoint.validate()
+	var client cmdClient
+	if err == nil {
+		client, err = newCmdClient(endpoint)
+	}
+	if err != nil {
+		logger.Logger.Error(
+			"failed to restore command proxy: ",
+			slog.Group(
+				logKey,
+				slog.String("nickname", endpoint.NickName),
+				slog.String("error", err.Error()),
+			),
+		)
+		return
+	}
+
+	reqClientMapMutex.Lock()
+	if _, exist := reqClientMap[endpoint.NickName]; exist {
+		reqClientMapMutex.Unlock()
+		_ = client.Close()
+		logger.Logger.Warn(
+			"skipping duplicate command proxy: ",
+			slog.Group(
+				logKey,
+				slog.String("nickname", endpoint.NickName),
+			),
+		)
+		return
+	}
+	reqClientMap[endpoint.NickName] = client
+	reqClientMapMutex.Unlock()
+
+	logger.Logger.Info(
+		"restored command proxy: ",
+		slog.Group(
+			logKey,
+			slog.String("nickname", endpoint.NickName),
+			slog.String("hostname", endpoint.Hostname),
+			slog.Int("port", int(endpoint.Port)),
+			slog.String("mode", endpoint.Mode),
+			slog.Bool("static", endpoint.Static),
+		),
+	)
+
+	go keepAlive(client)
+}
+
+func loadProxies() []Endpoint {
+	data, err := os.ReadFile(storeFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Logger.Error(
+				"failed to read command proxies: ",
+				slog.Group(
+					logKey,
+					slog.String("error", err.Error()),
+				),
+			)
+		}
+		return nil
+	}
+
+	var endpoints []Endpoint
+	if err := json.Unmarshal(data, &endpoints); err != nil {
+		logger.Logger.Error(
+			"invalid command proxies file: ",
+			slog.Group(
+				logKey,
+				slog.String("error", err.Error()),
+			),
+		)
+		return nil
+	}
+	return endpoints
+}
+
+// persist every proxy not declared in the config file, reqClientMapMutex
+// must be held
+func saveProxiesLocked() error {
+	if storeFile == "" {
+		// not initialized
+		return nil
+	}
+
+	endpoints := make([]Endpoint, 0, len(reqClientMap))
+	for _, client := range reqClientMap {
+		if client.base().static {
+			continue
+		}
+		endpoints = append(endpoints, client.base().endpoint())
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].NickName < endpoints[j].NickName
+	})
+
+	data, err := json.MarshalIndent(endpoints, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal command proxies: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(storeFile), 0o755); err != nil {
+		return fmt.Errorf("failed to create command proxy store: %w", err)
+	}
+	if err := os.WriteFile(storeFile, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write command proxies: %w", err)
+	}
+	return nil
+}
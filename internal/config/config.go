@@ -16,16 +16,58 @@ type EmailConfig struct {
 	Subscriber []string `mapstructure:"send_email_to"`
 }
 
+// StaticProxyConfig is a command proxy started with the service
+type StaticProxyConfig struct {
+	NickName string `mapstructure:"nickname"`
+	Hostname string `mapstructure:"hostname"`
+	Port     uint   `mapstructure:"port"`
+	Mode     string `mapstructure:"mode"`
+	// Z85 encoded CURVE public key of the task server
+	ServerKey string `mapstructure:"server_key"`
+	// overrides of the proxy defaults, zero uses the default
+	HandshakeTimeout int `mapstructure:"handshake_timeout"`
+	MsgTimeout       int `mapstructure:"msg_timeout"`
+	MaxRetries       int `mapstructure:"max_retries"`
+	RetryInterval    int `mapstructure:"retry_interval"`
+}
+
 type ProxyConfig struct {
 	HandshakeTimeout int `mapstructure:"handshake_timeout"`
 	MsgTimeout       int `mapstructure:"msg_timeout"`
 	MaxRetries       int `mapstructure:"max_retries"`
 	RetryInterval    int `mapstructure:"retry_interval"`
+	// Milliseconds between heartbeats of a command proxy
+	HeartbeatInterval int `mapstructure:"heartbeat_interval"`
+	// Consecutive failed heartbeats before a proxy is considered down
+	HeartbeatFailures int `mapstructure:"heartbeat_failures"`
+	// Command proxies started with the service
+	Static []StaticProxyConfig `mapstructure:"static"`
+}
+
+type BroadcastConfig struct {
+	MaxCount     int    `mapstructure:"max_count"`
+	MaxBytes     int64  `mapstructure:"max_bytes"`
+	MaxAge       int64  `mapstructure:"max_age"`
+	SegmentBytes int64  `mapstructure:"segment_bytes"`
+	Policy       string `mapstructure:"policy"`
+	BufferSize   int    `mapstructure:"buffer_size"`
+	BlockTimeout int    `mapstructure:"block_timeout"`
+}
+
+// RPCConfig is the ZMQ listener task code uses to call cogmoteGO
+type RPCConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// ZMQ endpoint to bind, e.g. tcp://127.0.0.1:9013
+	Address string `mapstructure:"address"`
+	// Socket type, rep or router
+	Mode string `mapstructure:"mode"`
 }
 
 type Config struct {
-	Email EmailConfig `mapstructure:"email"`
-	Proxy ProxyConfig `mapstructure:"proxy"`
+	Email     EmailConfig     `mapstructure:"email"`
+	Proxy     ProxyConfig     `mapstructure:"proxy"`
+	Broadcast BroadcastConfig `mapstructure:"broadcast"`
+	RPC       RPCConfig       `mapstructure:"rpc"`
 }
 
 func LoadConfig(cfgFile string) Config {
@@ -40,6 +82,20 @@ func LoadConfig(cfgFile string) Config {
 	viper.SetDefault("proxy.msg_timeout", 5000)
 	viper.SetDefault("proxy.max_retries", 3)
 	viper.SetDefault("proxy.retry_interval", 200)
+	viper.SetDefault("proxy.heartbeat_interval", 2000)
+	viper.SetDefault("proxy.heartbeat_failures", 3)
+
+	viper.SetDefault("rpc.enabled", false)
+	viper.SetDefault("rpc.address", "tcp://127.0.0.1:9013")
+	viper.SetDefault("rpc.mode", "rep")
+
+	viper.SetDefault("broadcast.max_count", 10000)
+	viper.SetDefault("broadcast.max_bytes", 64<<20)
+	viper.SetDefault("broadcast.max_age", 0)
+	viper.SetDefault("broadcast.segment_bytes", 4<<20)
+	viper.SetDefault("broadcast.policy", "drop-newest")
+	viper.SetDefault("broadcast.buffer_size", 64)
+	viper.SetDefault("broadcast.block_timeout", 100)
 
 	configPath := cfgFile
 
@@ -2,6 +2,7 @@ package email
 
 import (
 	"bytes"
+	"errors"
 	"log/slog"
 	"net/http"
 	"strings"
@@ -35,6 +36,19 @@ type emailConfig struct {
 
 const logKey = "email"
 
+// emailError is reported to API clients as its message and detail
+type emailError struct {
+	message string
+	detail  string
+}
+
+func (e *emailError) Error() string {
+	if e.detail == "" {
+		return e.message
+	}
+	return e.message + ": " + e.detail
+}
+
 func PostEmailHandler(c *gin.Context) {
 	payload, ok := parseEmailPayload(c)
 	if !ok {
@@ -111,25 +125,31 @@ func parseEmailPayload(c *gin.Context) (emailPayload, bool) {
 }
 
 func loadEmailConfig(c *gin.Context) (emailConfig, bool) {
+	cfg, err := readEmailConfig()
+	if err != nil {
+		respondEmailError(c, err)
+		return emailConfig{}, false
+	}
+	return cfg, true
+}
+
+func readEmailConfig() (emailConfig, error) {
 	emailSection := viper.Sub("email")
 	if emailSection == nil {
 		logger.Logger.Error("email configuration not found")
-		respondError(c, http.StatusInternalServerError, "email configuration not found", "")
-		return emailConfig{}, false
+		return emailConfig{}, &emailError{message: "email configuration not found"}
 	}
 
 	sendEmail := strings.TrimSpace(emailSection.GetString("send_email"))
 	if sendEmail == "" {
 		logger.Logger.Error("send_email not configured")
-		respondError(c, http.StatusInternalServerError, "send_email not configured", "")
-		return emailConfig{}, false
+		return emailConfig{}, &emailError{message: "send_email not configured"}
 	}
 
 	smtpHost := strings.TrimSpace(emailSection.GetString("smtp_host"))
 	if smtpHost == "" {
 		logger.Logger.Error("smtp_host not configured")
-		respondError(c, http.StatusInternalServerError, "smtp_host not configured", "")
-		return emailConfig{}, false
+		return emailConfig{}, &emailError{message: "smtp_host not configured"}
 	}
 
 	smtpPort := emailSection.GetInt("smtp_port")
@@ -139,8 +159,7 @@ func loadEmailConfig(c *gin.Context) (emailConfig, bool) {
 				slog.Int("value", smtpPort),
 			),
 		)
-		respondError(c, http.StatusInternalServerError, "smtp_port not configured", "")
-		return emailConfig{}, false
+		return emailConfig{}, &emailError{message: "smtp_port not configured"}
 	}
 
 	rawRecipients := emailSection.GetStringSlice("send_email_to")
@@ -153,8 +172,7 @@ func loadEmailConfig(c *gin.Context) (emailConfig, bool) {
 	}
 	if len(recipients) == 0 {
 		logger.Logger.Error("send_email_to not configured")
-		respondError(c, http.StatusInternalServerError, "send_email_to not configured", "")
-		return emailConfig{}, false
+		return emailConfig{}, &emailError{message: "send_email_to not configured"}
 	}
 
 	password, err := keyring.GetPassword(sendEmail)
@@ -164,8 +182,7 @@ func loadEmailConfig(c *gin.Context) (emailConfig, bool) {
 				slog.String("detail", err.Error()),
 			),
 		)
-		respondError(c, http.StatusInternalServerError, "email password not found", err.Error())
-		return emailConfig{}, false
+		return emailConfig{}, &emailError{message: "email password not found", detail: err.Error()}
 	}
 
 	return emailConfig{
@@ -174,10 +191,33 @@ func loadEmailConfig(c *gin.Context) (emailConfig, bool) {
 		Host:       smtpHost,
 		Port:       smtpPort,
 		Recipients: recipients,
-	}, true
+	}, nil
 }
 
 func buildEmailMessage(c *gin.Context, cfg emailConfig, payload emailPayload) (*mail.Msg, bool) {
+	message, err := newEmailMessage(cfg, payload.Subject, payload.HTMLBody)
+	if err != nil {
+		respondEmailError(c, err)
+		return nil, false
+	}
+
+	for _, attachment := range payload.Attachments {
+		if err := message.AttachReader(attachment.Filename, bytes.NewReader(attachment.Content)); err != nil {
+			logger.Logger.Error("invalid attachment",
+				slog.Group(logKey,
+					slog.String("detail", err.Error()),
+					slog.String("filename", attachment.Filename),
+				),
+			)
+			respondError(c, http.StatusBadRequest, "invalid attachment", err.Error())
+			return nil, false
+		}
+	}
+
+	return message, true
+}
+
+func newEmailMessage(cfg emailConfig, subject string, htmlBody string) (*mail.Msg, error) {
 	message := mail.NewMsg()
 	if err := message.From(cfg.From); err != nil {
 		logger.Logger.Error("failed to prepare email",
@@ -185,8 +225,7 @@ func buildEmailMessage(c *gin.Context, cfg emailConfig, payload emailPayload) (*
 				slog.String("detail", err.Error()),
 			),
 		)
-		respondError(c, http.StatusInternalServerError, "failed to prepare email", err.Error())
-		return nil, false
+		return nil, &emailError{message: "failed to prepare email", detail: err.Error()}
 	}
 
 	if err := message.To(cfg.Recipients...); err != nil {
@@ -195,31 +234,25 @@ func buildEmailMessage(c *gin.Context, cfg emailConfig, payload emailPayload) (*
 				slog.String("detail", err.Error()),
 			),
 		)
-		respondError(c, http.StatusInternalServerError, "failed to prepare email", err.Error())
-		return nil, false
+		return nil, &emailError{message: "failed to prepare email", detail: err.Error()}
 	}
 
-	message.Subject(payload.Subject)
-
-	message.SetBodyString(mail.TypeTextHTML, payload.HTMLBody)
+	message.Subject(subject)
 
-	for _, attachment := range payload.Attachments {
-		if err := message.AttachReader(attachment.Filename, bytes.NewReader(attachment.Content)); err != nil {
-			logger.Logger.Error("invalid attachment",
-				slog.Group(logKey,
-					slog.String("detail", err.Error()),
-					slog.String("filename", attachment.Filename),
-				),
-			)
-			respondError(c, http.StatusBadRequest, "invalid attachment", err.Error())
-			return nil, false
-		}
-	}
+	message.SetBodyString(mail.TypeTextHTML, htmlBody)
 
-	return message, true
+	return message, nil
 }
 
 func deliverEmail(c *gin.Context, cfg emailConfig, message *mail.Msg) bool {
+	if err := sendEmail(cfg, message); err != nil {
+		respondEmailError(c, err)
+		return false
+	}
+	return true
+}
+
+func sendEmail(cfg emailConfig, message *mail.Msg) error {
 	client, err := mail.NewClient(
 		cfg.Host,
 		mail.WithPort(cfg.Port),
@@ -233,8 +266,7 @@ func deliverEmail(c *gin.Context, cfg emailConfig, message *mail.Msg) bool {
 				slog.String("detail", err.Error()),
 			),
 		)
-		respondError(c, http.StatusInternalServerError, "failed to send email", err.Error())
-		return false
+		return &emailError{message: "failed to send email", detail: err.Error()}
 	}
 
 	if err := client.DialAndSend(message); err != nil {
@@ -243,11 +275,34 @@ func deliverEmail(c *gin.Context, cfg emailConfig, message *mail.Msg) bool {
 				slog.String("detail", err.Error()),
 			),
 		)
-		respondError(c, http.StatusInternalServerError, "failed to send email", err.Error())
-		return false
+		return &emailError{message: "failed to send email", detail: err.Error()}
 	}
 
-	return true
+	return nil
+}
+
+// Send an HTML email to the configured recipients
+func Send(subject string, htmlBody string) error {
+	cfg, err := readEmailConfig()
+	if err != nil {
+		return err
+	}
+
+	message, err := newEmailMessage(cfg, subject, htmlBody)
+	if err != nil {
+		return err
+	}
+
+	return sendEmail(cfg, message)
+}
+
+func respondEmailError(c *gin.Context, err error) {
+	var emailErr *emailError
+	if errors.As(err, &emailErr) {
+		respondError(c, http.StatusInternalServerError, emailErr.message, emailErr.detail)
+		return
+	}
+	respondError(c, http.StatusInternalServerError, err.Error(), "")
 }
 
 func respondError(c *gin.Context, status int, userMessage string, detail string) {
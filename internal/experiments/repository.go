@@ -186,7 +186,30 @@ func (r *Repository) loadJson() {
 
 	for _, record := range data {
 		r.experimentRecords.Store(record.ID, record)
+
+		// serve the data of restored experiments again
+		if path, err := record.dataDir(); err == nil {
+			dataFS.Add(path)
+		}
+	}
+}
+
+// absolute data path of the experiment
+func (record ExperimentRecord) dataDir() (string, error) {
+	if record.Experiment.DataPath == nil || *record.Experiment.DataPath == "" {
+		return "", fmt.Errorf("experiment %s has no data path", record.ID)
+	}
+	return filepath.Abs(*record.Experiment.DataPath)
+}
+
+// DataDir returns the absolute data path of a registered experiment, files
+// written there are served under /data
+func DataDir(id string) (string, error) {
+	value, exists := repo.experimentRecords.Load(id)
+	if !exists {
+		return "", fmt.Errorf("experiment with ID %s not found", id)
 	}
+	return value.(ExperimentRecord).dataDir()
 }
 
 func (r *Repository) validateIfExperimentExists(id string) bool {
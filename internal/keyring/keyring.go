@@ -22,3 +22,39 @@ func GetPassword(username string) (string, error) {
 func DeleteCredentials(username string) error {
 	return keyring.Delete(ServiceName, username)
 }
+
+// accounts the CURVE keypair command proxies authenticate with is stored
+// under
+const (
+	curvePublicAccount = "zmq-curve-public"
+	curveSecretAccount = "zmq-curve-secret"
+)
+
+// SaveCurveKeyPair stores the Z85 encoded CURVE keypair of the command
+// proxies
+func SaveCurveKeyPair(public, secret string) error {
+	if public == "" || secret == "" {
+		return fmt.Errorf("public and secret key cannot be empty")
+	}
+	if err := keyring.Set(ServiceName, curveSecretAccount, secret); err != nil {
+		return err
+	}
+	return keyring.Set(ServiceName, curvePublicAccount, public)
+}
+
+// GetCurveKeyPair returns the stored CURVE keypair, keyring.ErrNotFound
+// when none was generated yet
+func GetCurveKeyPair() (public string, secret string, err error) {
+	public, err = keyring.Get(ServiceName, curvePublicAccount)
+	if err != nil {
+		return "", "", err
+	}
+	secret, err = keyring.Get(ServiceName, curveSecretAccount)
+	if err != nil {
+		return "", "", err
+	}
+	return public, secret, nil
+}
+
+// ErrNotFound is returned when nothing is stored under an account
+var ErrNotFound = keyring.ErrNotFound
@@ -0,0 +1,155 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/Ccccraz/cogmoteGO/internal/broadcast"
+	cmdproxy "github.com/Ccccraz/cogmoteGO/internal/cmdProxy"
+	"github.com/Ccccraz/cogmoteGO/internal/email"
+	"github.com/Ccccraz/cogmoteGO/internal/status"
+)
+
+type method func(params json.RawMessage) (any, error)
+
+// methods task code can call, each maps onto an API call
+var methods map[string]method
+
+func init() {
+	methods = map[string]method{
+		"ping":              ping,
+		"methods":           listMethods,
+		"status.get":        getStatus,
+		"status.update":     updateStatus,
+		"broadcast.publish": publish,
+		"email.send":        sendEmail,
+		"cmds.send":         sendCmd,
+	}
+}
+
+func bindParams(params json.RawMessage, v any) error {
+	if len(params) == 0 {
+		return &Error{Code: http.StatusBadRequest, Message: "params are required"}
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &Error{Code: http.StatusBadRequest, Message: "invalid params", Detail: err.Error()}
+	}
+	return nil
+}
+
+func ping(json.RawMessage) (any, error) {
+	return "pong", nil
+}
+
+func listMethods(json.RawMessage) (any, error) {
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// like GET /status
+func getStatus(json.RawMessage) (any, error) {
+	return status.Current(), nil
+}
+
+// like PATCH /status, params {"id": "...", "is_running": true}
+func updateStatus(params json.RawMessage) (any, error) {
+	var fields map[string]any
+	if err := bindParams(params, &fields); err != nil {
+		return nil, err
+	}
+
+	current, err := status.Update(fields)
+	if err != nil {
+		return nil, &Error{Code: http.StatusBadRequest, Message: "failed to update status", Detail: err.Error()}
+	}
+	return current, nil
+}
+
+// like POST /broadcast/data/:name, params
+// {"name": "...", "data": ..., "content_type": "..."}. data is published as
+// JSON unless content_type is set, then it must be a string holding the
+// message.
+func publish(params json.RawMessage) (any, error) {
+	var p struct {
+		Name        string          `json:"name"`
+		Data        json.RawMessage `json:"data"`
+		ContentType string          `json:"content_type"`
+	}
+	if err := bindParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Name == "" || len(p.Data) == 0 {
+		return nil, &Error{Code: http.StatusBadRequest, Message: "name and data are required"}
+	}
+
+	data := []byte(p.Data)
+	contentType := "application/json"
+	if p.ContentType != "" {
+		var text string
+		if err := json.Unmarshal(p.Data, &text); err != nil {
+			return nil, &Error{Code: http.StatusBadRequest, Message: "data must be a string when content_type is set"}
+		}
+		data = []byte(text)
+		contentType = p.ContentType
+	}
+
+	seq, err := broadcast.Publish(p.Name, data, contentType)
+	switch {
+	case errors.Is(err, broadcast.ErrEndpointNotFound):
+		return nil, &Error{Code: http.StatusNotFound, Message: err.Error()}
+	case errors.Is(err, broadcast.ErrSchemaViolation):
+		return nil, &Error{Code: http.StatusUnprocessableEntity, Message: "data rejected by schema", Detail: err.Error()}
+	case err != nil:
+		return nil, &Error{Code: http.StatusInternalServerError, Message: "failed to publish data", Detail: err.Error()}
+	}
+	return map[string]uint64{"seq": seq}, nil
+}
+
+// like POST /email, params {"subject": "...", "body": "<html>"}
+func sendEmail(params json.RawMessage) (any, error) {
+	var p struct {
+		Subject string `json:"subject"`
+		Body    string `json:"body"`
+	}
+	if err := bindParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Subject == "" {
+		return nil, &Error{Code: http.StatusBadRequest, Message: "subject is required"}
+	}
+
+	if err := email.Send(p.Subject, p.Body); err != nil {
+		return nil, &Error{Code: http.StatusInternalServerError, Message: "failed to send email", Detail: err.Error()}
+	}
+	return "sent", nil
+}
+
+// like POST /cmds/proxies/:nickname, params {"nickname": "...", "payload": ...}
+// the reply of the task server is returned as is when it is JSON
+func sendCmd(params json.RawMessage) (any, error) {
+	var p struct {
+		NickName string          `json:"nickname"`
+		Payload  json.RawMessage `json:"payload"`
+	}
+	if err := bindParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.NickName == "" || len(p.Payload) == 0 {
+		return nil, &Error{Code: http.StatusBadRequest, Message: "nickname and payload are required"}
+	}
+
+	data, code, err := cmdproxy.SendCommand(p.NickName, p.Payload, "rpc")
+	if err != nil {
+		return nil, &Error{Code: code, Message: "failed to send command", Detail: err.Error()}
+	}
+	if json.Valid(data) {
+		return json.RawMessage(data), nil
+	}
+	return string(data), nil
+}
@@ -0,0 +1,337 @@
+// Package rpc lets task code drive cogmoteGO over ZMQ. Requests are JSON
+//
+//	{"id": 1, "method": "status.update", "params": {"is_running": true}}
+//
+// and every request is answered with
+//
+//	{"id": 1, "result": ...}
+//
+// or, when it failed, with an error carrying the HTTP status the matching
+// API call would answer with
+//
+//	{"id": 1, "error": {"code": 404, "message": "...", "detail": "..."}}
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Ccccraz/cogmoteGO/internal/config"
+	"github.com/Ccccraz/cogmoteGO/internal/logger"
+	zmq "github.com/pebbe/zmq4"
+)
+
+const logKey = "rpc"
+
+// socket types of the listener
+const (
+	// one request at a time, for REQ clients
+	ModeREP = "rep"
+	// requests of many clients handled concurrently, for REQ and DEALER
+	// clients
+	ModeROUTER = "router"
+)
+
+type Request struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type Response struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Result any             `json:"result"`
+	Error  *Error          `json:"error,omitempty"`
+}
+
+// a response carries either its error or its result, which is kept even
+// when it is null so clients can tell a success apart
+func (r Response) MarshalJSON() ([]byte, error) {
+	if r.Error != nil {
+		return json.Marshal(struct {
+			ID    json.RawMessage `json:"id,omitempty"`
+			Error *Error          `json:"error"`
+		}{r.ID, r.Error})
+	}
+	return json.Marshal(struct {
+		ID     json.RawMessage `json:"id,omitempty"`
+		Result any             `json:"result"`
+	}{r.ID, r.Result})
+}
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Detail == "" {
+		return e.Message
+	}
+	return e.Message + ": " + e.Detail
+}
+
+var (
+	serverMu sync.Mutex
+	server   *listener
+)
+
+type listener struct {
+	context *zmq.Context
+	socket  *zmq.Socket
+	mode    string
+	done    chan struct{}
+	stopped chan struct{}
+
+	// replies of the ROUTER requests handled in the background
+	replies chan [][]byte
+}
+
+// Init starts the listener when it is enabled in the config
+func Init(cfg config.Config) {
+	if !cfg.RPC.Enabled {
+		return
+	}
+
+	if err := Start(cfg.RPC.Address, cfg.RPC.Mode); err != nil {
+		logger.Logger.Error(
+			"failed to start rpc listener: ",
+			slog.Group(
+				logKey,
+				slog.String("address", cfg.RPC.Address),
+				slog.String("error", err.Error()),
+			),
+		)
+	}
+}
+
+// Start binds the listener to address, mode is rep (default) or router
+func Start(address string, mode string) error {
+	if mode == "" {
+		mode = ModeREP
+	}
+	var socketType zmq.Type
+	switch mode {
+	case ModeREP:
+		socketType = zmq.REP
+	case ModeROUTER:
+		socketType = zmq.ROUTER
+	default:
+		return fmt.Errorf("unsupported mode: %s", mode)
+	}
+
+	serverMu.Lock()
+	defer serverMu.Unlock()
+
+	if server != nil {
+		return fmt.Errorf("rpc listener already started")
+	}
+
+	zctx, err := zmq.NewContext()
+	if err != nil {
+		return fmt.Errorf("failed to create context: %w", err)
+	}
+
+	s, err := zctx.NewSocket(socketType)
+	if err != nil {
+		_ = zctx.Term()
+		return fmt.Errorf("failed to create socket: %w", err)
+	}
+	if err := s.SetLinger(0); err != nil {
+		_ = s.Close()
+		_ = zctx.Term()
+		return fmt.Errorf("failed to set linger: %w", err)
+	}
+	if err := s.Bind(address); err != nil {
+		_ = s.Close()
+		_ = zctx.Term()
+		return fmt.Errorf("failed to bind %s: %w", address, err)
+	}
+
+	server = &listener{
+		context: zctx,
+		socket:  s,
+		mode:    mode,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		replies: make(chan [][]byte, 64),
+	}
+	go server.run()
+
+	logger.Logger.Info(
+		"rpc listener started: ",
+		slog.Group(
+			logKey,
+			slog.String("address", address),
+			slog.String("mode", mode),
+		),
+	)
+	return nil
+}
+
+// Stop closes the listener, requests being handled are answered no more
+func Stop() error {
+	serverMu.Lock()
+	l := server
+	server = nil
+	serverMu.Unlock()
+
+	if l == nil {
+		return nil
+	}
+
+	close(l.done)
+	<-l.stopped
+	return l.context.Term()
+}
+
+// interval the ROUTER loop checks for replies and Stop in
+const pollInterval = 20 * time.Millisecond
+
+// socket loop, the only user of the socket
+func (l *listener) run() {
+	defer close(l.stopped)
+	defer l.socket.Close()
+
+	poller := zmq.NewPoller()
+	poller.Add(l.socket, zmq.POLLIN)
+
+	for {
+		select {
+		case <-l.done:
+			return
+		default:
+		}
+
+		l.flushReplies()
+
+		polled, err := poller.Poll(pollInterval)
+		if err != nil {
+			if zmq.AsErrno(err) == zmq.Errno(syscall.EINTR) {
+				continue
+			}
+			logger.Logger.Error(
+				"rpc listener stopped: ",
+				slog.Group(
+					logKey,
+					slog.String("error", err.Error()),
+				),
+			)
+			return
+		}
+		if len(polled) == 0 {
+			continue
+		}
+
+		frames, err := l.socket.RecvMessageBytes(zmq.DONTWAIT)
+		if err != nil {
+			continue
+		}
+
+		if l.mode == ModeREP {
+			// a REP socket must answer before it receives again
+			if _, err := l.socket.SendBytes(handle(frames[len(frames)-1]), 0); err != nil {
+				logger.Logger.Warn(
+					"failed to send rpc response: ",
+					slog.Group(
+						logKey,
+						slog.String("error", err.Error()),
+					),
+				)
+			}
+			continue
+		}
+
+		// identity and empty delimiter of REQ clients are sent back with
+		// the reply
+		if len(frames) < 2 {
+			continue
+		}
+		envelope := frames[:len(frames)-1]
+		body := frames[len(frames)-1]
+		go func() {
+			reply := append(envelope[:len(envelope):len(envelope)], handle(body))
+			select {
+			case l.replies <- reply:
+			case <-l.done:
+			}
+		}()
+	}
+}
+
+func (l *listener) flushReplies() {
+	for {
+		select {
+		case reply := <-l.replies:
+			parts := make([]any, len(reply))
+			for i, frame := range reply {
+				parts[i] = frame
+			}
+			if _, err := l.socket.SendMessageDontwait(parts...); err != nil {
+				logger.Logger.Warn(
+					"failed to send rpc response: ",
+					slog.Group(
+						logKey,
+						slog.String("error", err.Error()),
+					),
+				)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// answer one request
+func handle(body []byte) []byte {
+	var req Request
+	resp := Response{}
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		resp.Error = &Error{Code: http.StatusBadRequest, Message: "invalid request", Detail: err.Error()}
+	} else {
+		resp.ID = req.ID
+		result, err := call(req)
+		if err != nil {
+			var rpcErr *Error
+			if !errors.As(err, &rpcErr) {
+				rpcErr = &Error{Code: http.StatusInternalServerError, Message: "request failed", Detail: err.Error()}
+			}
+			resp.Error = rpcErr
+			logger.Logger.Warn(
+				"rpc request failed: ",
+				slog.Group(
+					logKey,
+					slog.String("method", req.Method),
+					slog.String("error", rpcErr.Error()),
+				),
+			)
+		} else {
+			resp.Result = result
+		}
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		data, _ = json.Marshal(Response{
+			ID:    resp.ID,
+			Error: &Error{Code: http.StatusInternalServerError, Message: "failed to marshal response", Detail: err.Error()},
+		})
+	}
+	return data
+}
+
+func call(req Request) (any, error) {
+	method, exists := methods[req.Method]
+	if !exists {
+		return nil, &Error{Code: http.StatusNotFound, Message: fmt.Sprintf("method %s not found", req.Method)}
+	}
+	return method(req.Params)
+}
@@ -1,6 +1,7 @@
 package status
 
 import (
+	"errors"
 	"net/http"
 	"sync"
 
@@ -17,6 +18,55 @@ var (
 	statusMutex = &sync.Mutex{}
 )
 
+// statusError is reported to API clients as its message and detail
+type statusError struct {
+	message string
+	detail  string
+}
+
+func (e *statusError) Error() string {
+	return e.message + ": " + e.detail
+}
+
+// Update sets the id and is_running fields present in updateData and
+// returns the new status, fields of the wrong type are rejected
+func Update(updateData map[string]any) (experiments.ExperimentStatus, error) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+
+	if id, exist := updateData["id"]; exist {
+		idStr, ok := id.(string)
+		if !ok {
+			return *currentStatus, &statusError{
+				message: "failed to update id field",
+				detail:  "id field must be a string",
+			}
+		}
+		currentStatus.ID = idStr
+	}
+
+	if isRunning, exist := updateData["is_running"]; exist {
+		isRunningBool, ok := isRunning.(bool)
+		if !ok {
+			return *currentStatus, &statusError{
+				message: "failed to update is_running field",
+				detail:  "is_running field must be a boolean",
+			}
+		}
+		currentStatus.IsRunning = isRunningBool
+	}
+
+	return *currentStatus, nil
+}
+
+// Current returns the current experiment status
+func Current() experiments.ExperimentStatus {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+
+	return *currentStatus
+}
+
 func UpdateExperimentStatusHandler(c *gin.Context) {
 	var updateData map[string]any
 	if err := c.ShouldBindJSON(&updateData); err != nil {
@@ -27,40 +77,28 @@ func UpdateExperimentStatusHandler(c *gin.Context) {
 		return
 	}
 
-	statusMutex.Lock()
-	defer statusMutex.Unlock()
-
-	if id, exist := updateData["id"]; exist {
-		if idStr, ok := id.(string); ok {
-			currentStatus.ID = idStr
-		} else {
+	current, err := Update(updateData)
+	if err != nil {
+		var statusErr *statusError
+		if errors.As(err, &statusErr) {
 			c.JSON(http.StatusBadRequest, commonTypes.APIError{
-				Error:  "failed to update id field",
-				Detail: "id field must be a string",
+				Error:  statusErr.message,
+				Detail: statusErr.detail,
 			})
 			return
 		}
+		c.JSON(http.StatusInternalServerError, commonTypes.APIError{
+			Error:  "failed to update status",
+			Detail: err.Error(),
+		})
+		return
 	}
 
-	if isRunning, exist := updateData["is_running"]; exist {
-		if isRunningBool, ok := isRunning.(bool); ok {
-			currentStatus.IsRunning = isRunningBool
-		} else {
-			c.JSON(http.StatusBadRequest, commonTypes.APIError{
-				Error:  "failed to update is_running field",
-				Detail: "is_running field must be a boolean",
-			})
-		}
-	}
-
-	c.JSON(http.StatusOK, currentStatus)
+	c.JSON(http.StatusOK, current)
 }
 
 func GetExperimentStatusHandler(c *gin.Context) {
-	statusMutex.Lock()
-	defer statusMutex.Unlock()
-
-	c.JSON(http.StatusOK, currentStatus)
+	c.JSON(http.StatusOK, Current())
 }
 
 func RegisterRoutes(r gin.IRouter) {